@@ -0,0 +1,131 @@
+//
+// Copyright 2018 Cristian Maglie. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// defaultBlobAlgorithm is the digest algorithm used to address the blobs if
+// no checksum is given.
+const defaultBlobAlgorithm = "sha256"
+
+// BlobStore is a content-addressed store of downloaded files. Each content
+// is stored once, in a blob named after its digest, and the requested
+// destinations are linked to the blob: downloads of different urls with the
+// same content share the same blob.
+type BlobStore struct {
+	dir    string
+	config Config
+}
+
+// NewBlobStore creates a BlobStore that keeps the blobs in the given
+// directory and performs the downloads with the given configuration.
+func NewBlobStore(dir string, config Config) *BlobStore {
+	return &BlobStore{dir: dir, config: config}
+}
+
+// Fetch makes file a link to the blob with the content of the specified url,
+// and returns true if the content has been downloaded. If checksum (in the
+// form "algorithm:hexdigest", see Config.ExpectedChecksum) is not empty and
+// the store already contains a blob with that digest nothing is downloaded,
+// otherwise the download is verified against it.
+//
+// The destination is a hard link to the blob, or a symbolic link if a hard
+// link can't be created (for example if the file is on another filesystem).
+// An already existing file is replaced. The destinations share the content
+// with the blob, so they must not be modified.
+func (s *BlobStore) Fetch(ctx context.Context, file string, reqURL string, checksum string) (bool, error) {
+	algorithm := defaultBlobAlgorithm
+	if checksum != "" {
+		var digest string
+		var err error
+		if algorithm, digest, err = parseChecksum(checksum); err != nil {
+			return false, err
+		}
+		blob, err := s.blobPath(algorithm, digest)
+		if err != nil {
+			return false, err
+		}
+		if _, err := os.Stat(blob); err == nil {
+			return false, link(blob, file)
+		}
+	}
+
+	tmpDir := filepath.Join(s.dir, "tmp")
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return false, fmt.Errorf("creating blob store: %s", err)
+	}
+	tmp, err := os.CreateTemp(tmpDir, "blob-")
+	if err != nil {
+		return false, fmt.Errorf("creating blob: %s", err)
+	}
+	_ = tmp.Close()
+	defer os.Remove(tmp.Name())
+	defer removeResumeMeta(tmp.Name())
+
+	config := s.config
+	config.ExpectedChecksum = checksum
+	config.ComputeDigests = append(append([]string{}, config.ComputeDigests...), algorithm)
+	d, err := DownloadWithConfigAndContext(ctx, tmp.Name(), reqURL, config, NoResume)
+	if err != nil {
+		return false, err
+	}
+	if err := d.Run(); err != nil {
+		return true, err
+	}
+
+	blob, err := s.blobPath(algorithm, d.Digests()[algorithm])
+	if err != nil {
+		return true, err
+	}
+	if _, err := os.Stat(blob); err != nil {
+		if err := os.MkdirAll(filepath.Dir(blob), 0755); err != nil {
+			return true, fmt.Errorf("creating blob store: %s", err)
+		}
+		if err := os.Rename(tmp.Name(), blob); err != nil {
+			return true, fmt.Errorf("storing blob: %s", err)
+		}
+	}
+	return true, link(blob, file)
+}
+
+// blobPath returns the path of the blob with the given digest. The digest
+// must be the lowercase hex encoding of a hash of the algorithm, so that it
+// can't point outside the store.
+func (s *BlobStore) blobPath(algorithm, digest string) (string, error) {
+	if len(digest) != 2*checksumAlgorithms[algorithm]().Size() {
+		return "", fmt.Errorf("invalid %s digest %q", algorithm, digest)
+	}
+	for _, c := range digest {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return "", fmt.Errorf("invalid %s digest %q", algorithm, digest)
+		}
+	}
+	return filepath.Join(s.dir, algorithm, digest), nil
+}
+
+// link replaces file with a link to blob.
+func link(blob string, file string) error {
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("replacing %s: %s", file, err)
+	}
+	if err := os.Link(blob, file); err == nil {
+		return nil
+	}
+	abs, err := filepath.Abs(blob)
+	if err != nil {
+		return fmt.Errorf("linking %s: %s", file, err)
+	}
+	if err := os.Symlink(abs, file); err != nil {
+		return fmt.Errorf("linking %s: %s", file, err)
+	}
+	return nil
+}
@@ -0,0 +1,313 @@
+//
+// Copyright 2018 Cristian Maglie. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package downloader
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// checksumAlgorithms are the supported checksum algorithms. crc32 (IEEE) and
+// crc32c (Castagnoli) are not cryptographically secure, and are supported
+// only for compatibility with legacy systems.
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"crc32":  func() hash.Hash { return crc32.NewIEEE() },
+	"crc32c": func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) },
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+// ChecksumMismatchError is returned when the checksum of the downloaded file
+// doesn't match the expected one.
+type ChecksumMismatchError struct {
+	Expected string
+	Got      string
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("checksum mismatch: expected %s, got %s", e.Expected, e.Got)
+}
+
+// parseChecksum splits a checksum in the form "algorithm:hexdigest".
+func parseChecksum(checksum string) (string, string, error) {
+	parts := strings.SplitN(checksum, ":", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("invalid checksum %q: must be in the form algorithm:digest", checksum)
+	}
+	algorithm := strings.ToLower(parts[0])
+	if _, ok := checksumAlgorithms[algorithm]; !ok {
+		return "", "", fmt.Errorf("invalid checksum %q: unsupported algorithm %s", checksum, parts[0])
+	}
+	return algorithm, strings.ToLower(parts[1]), nil
+}
+
+// startHashing prepares the hashes needed to verify the download. If the
+// download is resumed, the bytes already present on disk are hashed too.
+func (d *Downloader) startHashing() error {
+	algorithms := map[string]bool{}
+	for _, algorithm := range d.config.ComputeDigests {
+		algorithm = strings.ToLower(algorithm)
+		if _, ok := checksumAlgorithms[algorithm]; !ok {
+			return fmt.Errorf("unsupported digest algorithm %s", algorithm)
+		}
+		algorithms[algorithm] = true
+	}
+	if !d.skipVerification() {
+		needed, err := d.verificationAlgorithms()
+		if err != nil {
+			return err
+		}
+		for _, algorithm := range needed {
+			algorithms[algorithm] = true
+		}
+	}
+	if len(algorithms) == 0 {
+		return nil
+	}
+	d.hashes = map[string]hash.Hash{}
+	for algorithm := range algorithms {
+		d.hashes[algorithm] = checksumAlgorithms[algorithm]()
+	}
+
+	completed := d.Completed()
+	if completed == 0 || d.parallel != nil {
+		// Parallel downloads are hashed at the end
+		return nil
+	}
+	f, err := os.Open(d.path)
+	if err != nil {
+		return fmt.Errorf("hashing partial download: %s", err)
+	}
+	defer f.Close()
+	if _, err := io.CopyN(hashWriter{d}, f, completed); err != nil {
+		return fmt.Errorf("hashing partial download: %s", err)
+	}
+	return nil
+}
+
+// verificationAlgorithms returns the algorithms needed to verify the
+// download.
+func (d *Downloader) verificationAlgorithms() ([]string, error) {
+	var res []string
+	if d.config.ExpectedChecksum != "" {
+		algorithm, _, err := parseChecksum(d.config.ExpectedChecksum)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, algorithm)
+	}
+	if d.config.SRI != "" {
+		hashes, err := parseSRI(d.config.SRI)
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range hashes {
+			res = append(res, h.algorithm)
+		}
+	}
+	if d.config.ExpectedChecksumFunc != nil || d.config.VerifyServerChecksum {
+		// The algorithm is not known until the expected checksum is
+		// available, so all the supported hashes are computed.
+		for algorithm := range checksumAlgorithms {
+			res = append(res, algorithm)
+		}
+	}
+	return res, nil
+}
+
+// skipVerification returns true if the verification of the download must be
+// skipped because it has been resumed (see Config.VerifyOnlyFreshDownloads).
+func (d *Downloader) skipVerification() bool {
+	return d.config.VerifyOnlyFreshDownloads && d.resumed
+}
+
+// hash adds the given data to the hashes of the download
+func (d *Downloader) hash(data []byte) {
+	for _, h := range d.hashes {
+		_, _ = h.Write(data)
+	}
+}
+
+type hashWriter struct {
+	d *Downloader
+}
+
+func (w hashWriter) Write(data []byte) (int, error) {
+	w.d.hash(data)
+	return len(data), nil
+}
+
+// checksum returns the computed checksum for the given algorithm in the form
+// "algorithm:hexdigest".
+func (d *Downloader) checksum(algorithm string) string {
+	return algorithm + ":" + hex.EncodeToString(d.hashes[algorithm].Sum(nil))
+}
+
+// Digests returns the digests computed during the download, as a map from
+// the algorithm name to the hex encoded digest. It must be called after the
+// download is completed. The digests computed are the ones listed in
+// Config.ComputeDigests and the ones needed to verify the download.
+func (d *Downloader) Digests() map[string]string {
+	res := map[string]string{}
+	for algorithm, h := range d.hashes {
+		res[algorithm] = hex.EncodeToString(h.Sum(nil))
+	}
+	return res
+}
+
+// verify checks the completed download against the expected checksum.
+func (d *Downloader) verify() error {
+	if d.skipVerification() {
+		return nil
+	}
+	if d.config.ExpectedChecksum != "" {
+		if err := d.verifyChecksum(d.config.ExpectedChecksum); err != nil {
+			return err
+		}
+	}
+	if d.config.SRI != "" {
+		if err := d.verifySRI(d.config.SRI); err != nil {
+			return err
+		}
+	}
+	if d.config.VerifyServerChecksum {
+		if err := d.verifyServerChecksum(); err != nil {
+			return err
+		}
+	}
+	if d.config.ExpectedChecksumFunc != nil {
+		expected, err := d.config.ExpectedChecksumFunc()
+		if err != nil {
+			return fmt.Errorf("getting expected checksum: %s", err)
+		}
+		if err := d.verifyChecksum(expected); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sriHash is a single hash of a Subresource Integrity string
+type sriHash struct {
+	algorithm string
+	digest    string
+}
+
+// parseSRI parses a Subresource Integrity string, made of space separated
+// hashes in the form "algorithm-base64digest" (optionally followed by
+// "?options", that are ignored). Hashes with unsupported algorithms are
+// ignored, as browsers do.
+func parseSRI(sri string) ([]sriHash, error) {
+	var res []sriHash
+	for _, field := range strings.Fields(sri) {
+		parts := strings.SplitN(field, "-", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		algorithm := strings.ToLower(parts[0])
+		if algorithm != "sha256" && algorithm != "sha384" && algorithm != "sha512" {
+			continue
+		}
+		digest := strings.SplitN(parts[1], "?", 2)[0]
+		res = append(res, sriHash{algorithm: algorithm, digest: digest})
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("invalid SRI %q: no supported hashes", sri)
+	}
+	return res, nil
+}
+
+// verifySRI checks the download against a Subresource Integrity string. The
+// download is valid if at least one of the hashes matches.
+func (d *Downloader) verifySRI(sri string) error {
+	hashes, err := parseSRI(sri)
+	if err != nil {
+		return err
+	}
+	for _, h := range hashes {
+		if base64.StdEncoding.EncodeToString(d.hashes[h.algorithm].Sum(nil)) == h.digest {
+			return nil
+		}
+	}
+	got := hashes[0].algorithm + "-" + base64.StdEncoding.EncodeToString(d.hashes[hashes[0].algorithm].Sum(nil))
+	return &ChecksumMismatchError{Expected: sri, Got: got}
+}
+
+// digestAlgorithms maps the algorithm names used in the Digest,
+// Content-Digest and Repr-Digest HTTP headers to the supported checksum
+// algorithms.
+var digestAlgorithms = map[string]string{
+	"md5":     "md5",
+	"sha":     "sha1",
+	"sha-256": "sha256",
+	"sha-384": "sha384",
+	"sha-512": "sha512",
+	"crc32c":  "crc32c",
+}
+
+// verifyServerChecksum checks the download against the digests sent by the
+// server in the Digest (RFC 3230), Content-Digest or Repr-Digest (RFC 9530)
+// headers or trailers. The Content-Digest of a partial response covers only
+// the range sent, so it's not checked when the download has been resumed. If
+// the server didn't send any digest, no check is done.
+func (d *Downloader) verifyServerChecksum() error {
+	for _, name := range []string{"Digest", "Content-Digest", "Repr-Digest"} {
+		if name == "Content-Digest" && d.Resp.StatusCode == http.StatusPartialContent {
+			continue
+		}
+		value := d.Resp.Trailer.Get(name)
+		if value == "" {
+			value = d.Resp.Header.Get(name)
+		}
+		for _, item := range strings.Split(value, ",") {
+			parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			algorithm, ok := digestAlgorithms[strings.ToLower(parts[0])]
+			if !ok {
+				continue
+			}
+			expected := strings.Trim(parts[1], ":")
+			digest := d.hashes[algorithm].Sum(nil)
+			if expected != base64.StdEncoding.EncodeToString(digest) {
+				return &ChecksumMismatchError{
+					Expected: strings.TrimSpace(item),
+					Got:      parts[0] + "=" + base64.StdEncoding.EncodeToString(digest),
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// verifyChecksum compares the checksum of the download with the expected
+// one, in the form "algorithm:hexdigest".
+func (d *Downloader) verifyChecksum(expected string) error {
+	algorithm, digest, err := parseChecksum(expected)
+	if err != nil {
+		return err
+	}
+	if got := d.checksum(algorithm); got != algorithm+":"+digest {
+		return &ChecksumMismatchError{Expected: expected, Got: got}
+	}
+	return nil
+}
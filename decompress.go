@@ -0,0 +1,127 @@
+//
+// Copyright 2018 Cristian Maglie. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package downloader
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// gzipMagic are the first bytes of a gzip stream
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// isGzipFileName returns true if the name has the extension of a gzip file
+func isGzipFileName(name string) bool {
+	name = strings.ToLower(name)
+	return strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".tgz")
+}
+
+// decodeBody applies the decompression settings of the configuration to the
+// body of the response. name is the name of the downloaded file.
+func decodeBody(config Config, resp *http.Response, name string) error {
+	if config.SmartDecompress {
+		if err := smartDecompress(config, resp, name); err != nil {
+			return err
+		}
+	} else if config.Decompress && strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		if err := gunzipBody(resp, resp.Body); err != nil {
+			return err
+		}
+	}
+	if config.MaxDecompressedSize > 0 && resp.Uncompressed {
+		resp.Body = &multiReadCloser{
+			Reader: &decompressionLimitReader{r: resp.Body, remaining: config.MaxDecompressedSize},
+			Closer: resp.Body,
+		}
+	}
+	return nil
+}
+
+// decompressionLimitReader fails with ErrDecompressionLimitExceeded if more
+// than remaining bytes are read.
+type decompressionLimitReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *decompressionLimitReader) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, ErrDecompressionLimitExceeded
+	}
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n + int(l.remaining), ErrDecompressionLimitExceeded
+	}
+	return n, err
+}
+
+// smartDecompress handles a response with "Content-Encoding: gzip" avoiding
+// double decompression. The body is decoded once if the decoded content is
+// still gzip compressed (the server compressed an already compressed file),
+// it's kept as is if the decoded content is not compressed but name is a
+// gzip file (the server advertised a wrong Content-Encoding), otherwise it's
+// decoded as usual.
+func smartDecompress(config Config, resp *http.Response, name string) error {
+	if !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return nil
+	}
+
+	// Read the beginning of the body to look at the decoded content
+	head := make([]byte, 32*1024)
+	n, err := io.ReadFull(resp.Body, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return fmt.Errorf("reading response: %s", err)
+	}
+	head = head[:n]
+	body := &multiReadCloser{Reader: io.MultiReader(bytes.NewReader(head), resp.Body), Closer: resp.Body}
+	decodedHead := make([]byte, len(gzipMagic))
+	doubleEncoded := false
+	if zr, err := gzip.NewReader(bytes.NewReader(head)); err == nil {
+		if _, err := io.ReadFull(zr, decodedHead); err == nil {
+			doubleEncoded = bytes.Equal(decodedHead, gzipMagic)
+		}
+	}
+
+	if !doubleEncoded && isGzipFileName(name) {
+		config.logWarn("server sent Content-Encoding gzip for a gzip file, keeping the content as is", "url", resp.Request.URL.String())
+		resp.Body = body
+		return nil
+	}
+	if doubleEncoded {
+		config.logWarn("server compressed an already compressed file, decompressing only once", "url", resp.Request.URL.String())
+	}
+	return gunzipBody(resp, body)
+}
+
+// gunzipBody replaces the body of the response with the decompression of
+// body. The size of the decompressed content is unknown.
+func gunzipBody(resp *http.Response, body io.ReadCloser) error {
+	zr, err := gzip.NewReader(body)
+	if err != nil {
+		return fmt.Errorf("decompressing response: %s", err)
+	}
+	resp.Body = &multiReadCloser{Reader: zr, Closer: body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
+
+// multiReadCloser reads from Reader and closes Closer
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
+}
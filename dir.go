@@ -0,0 +1,133 @@
+//
+// Copyright 2018 Cristian Maglie. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// DownloadToDir returns an asynchronous downloader that will download the
+// specified url in the given directory. The name of the file is the one
+// suggested by the server in the Content-Disposition header (filename or
+// filename* parameter) or, if missing, the last segment of the path of the
+// final url (after redirects), sanitized to avoid path traversals. The
+// chosen name is available through the Downloader.FileName method. Since
+// the file name is known only after the request is sent, resume is not
+// possible and the NoResume option is implied.
+func DownloadToDir(dir string, reqURL string, config Config) (*Downloader, error) {
+	return DownloadToDirWithContext(context.Background(), dir, reqURL, config)
+}
+
+// DownloadToDirWithContext is like DownloadToDir, but the download can be
+// cancelled using the provided context.
+func DownloadToDirWithContext(ctx context.Context, dir string, reqURL string, config Config) (*Downloader, error) {
+	ctx, cancel := context.WithCancel(withWarnings(ctx))
+	client := config.httpClient()
+	resp, err := doRequest(ctx, client, reqURL, config, 0, "", "")
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	name := fileNameFromResponse(resp)
+	if config.InferExtension && path.Ext(name) == "" {
+		name += extensionFromContentType(resp.Header.Get("Content-Type"))
+	}
+	file := filepath.Join(dir, name)
+	if err := checkResponse(config, resp); err != nil {
+		_ = resp.Body.Close()
+		cancel()
+		return nil, err
+	}
+	if err := decodeBody(config, resp, file); err != nil {
+		_ = resp.Body.Close()
+		cancel()
+		return nil, err
+	}
+	if err := config.checkSymlink(file); err != nil {
+		_ = resp.Body.Close()
+		cancel()
+		return nil, err
+	}
+	if err := config.checkFreeSpace(file, resp.ContentLength); err != nil {
+		_ = resp.Body.Close()
+		cancel()
+		return nil, err
+	}
+	if resp.ContentLength >= 0 {
+		if err := config.checkMaxSize(resp.ContentLength); err != nil {
+			_ = resp.Body.Close()
+			cancel()
+			return nil, err
+		}
+	}
+	f, err := config.openFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, false)
+	if err != nil {
+		_ = resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("opening %s for writing: %s", file, err)
+	}
+
+	d := newDownloader(ctx, client, reqURL, config, resp, 0)
+	d.out = f
+	d.outCloser = f
+	d.path = file
+	d.cancel = cancel
+	return d, nil
+}
+
+// fileNameFromResponse returns a safe file name for the content of the
+// response, taken from the Content-Disposition header or from the last
+// segment of the url path.
+func fileNameFromResponse(resp *http.Response) string {
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil {
+		// filename* is decoded by ParseMediaType into filename
+		if name := params["filename"]; name != "" {
+			return sanitizeFileName(name)
+		}
+	}
+	u := resp.Request.URL
+	name := path.Base(u.Path)
+	if unescaped, err := url.PathUnescape(u.EscapedPath()); err == nil {
+		name = path.Base(unescaped)
+	}
+	return sanitizeFileName(name)
+}
+
+// sanitizeFileName returns a name that can be safely used as a file name in a
+// directory, removing any directory component.
+func sanitizeFileName(name string) string {
+	name = strings.ReplaceAll(name, "\\", "/")
+	name = path.Base(name)
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == ".." || name == "/" {
+		return "download"
+	}
+	return name
+}
+
+// extensionFromContentType returns the file extension for the given media
+// type, or an empty string if not known.
+func extensionFromContentType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	exts, err := mime.ExtensionsByType(mediaType)
+	if err != nil || len(exts) == 0 {
+		return ""
+	}
+	return exts[0]
+}
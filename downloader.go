@@ -7,25 +7,82 @@
 package downloader
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Downloader is an asynchronous downloader
 type Downloader struct {
-	URL           string
-	Done          chan bool
-	Resp          *http.Response
-	out           *os.File
+	// URL is the requested URL, before following any redirect. Resuming a
+	// download always starts again from it, so that a fresh redirect (for
+	// example to a signed URL with an expiration) is obtained.
+	URL  string
+	Done chan bool
+	Resp *http.Response
+	// body, if set, is the body of the response of the last reconnection,
+	// that replaces the body of Resp
+	body          io.ReadCloser
+	out           io.Writer
+	outCloser     io.Closer
+	path          string
 	completed     int64
+	downloaded    int64
+	firstByte     time.Time
+	lastByte      time.Time
+	setupDuration time.Duration
 	completedLock sync.Mutex
 	size          int64
 	err           error
+	config        Config
+	// alreadyComplete is set if the file is already completely downloaded
+	alreadyComplete bool
+	// notModified is set if the server replied 304 Not Modified (see
+	// Config.SkipIfUnmodified)
+	notModified bool
+	// resumed is set if the download continues a partial download
+	resumed bool
+	// resumedBytes is the size of the partial download that has been
+	// resumed
+	resumedBytes int64
+	throttle     *throttle
+	// parallel, if set, is the state of a parallel download
+	parallel *parallelDownload
+	// canceled is set by Cancel
+	canceled int32
+	// commitPath, if set, is the final destination of the download: the
+	// file at path is renamed to it once the download is verified
+	commitPath string
+	ctx        context.Context
+	cancel     context.CancelFunc
+	client     *http.Client
+
+	rate     RateEstimator
+	rateLock sync.Mutex
+
+	pauseLock sync.Mutex
+	paused    chan struct{}
+	pausedAt  time.Time
+	// warmUpStart is the start of the warm-up period of Config.MaxETA,
+	// restarted when the download is resumed after a pause
+	warmUpStart time.Time
+	hashes      map[string]hash.Hash
+
+	subscribersLock   sync.Mutex
+	subscribers       []chan int64
+	warnings          *warnings
+	subscribersClosed bool
 }
 
 // DownloadOptions are optional flags that can be passed to Download function
@@ -38,8 +95,17 @@ const (
 
 // Close the download
 func (d *Downloader) Close() error {
-	err1 := d.out.Close()
-	err2 := d.Resp.Body.Close()
+	var err1 error
+	if d.outCloser != nil {
+		err1 = d.outCloser.Close()
+	}
+	err2 := d.currentBody().Close()
+	if d.cancel != nil {
+		d.cancel()
+	}
+	if d.config.ownsTransport() {
+		d.client.CloseIdleConnections()
+	}
 	if err1 != nil {
 		return fmt.Errorf("closing output file: %s", err1)
 	}
@@ -49,11 +115,105 @@ func (d *Downloader) Close() error {
 	return nil
 }
 
-// Size return the size of the download
+// Cancel aborts the download. Run, RunAndPoll and the other Run* methods
+// return an error wrapping context.Canceled. The partial file is kept on
+// disk so the download may be resumed later. Calling Cancel on a completed
+// download has no effect.
+func (d *Downloader) Cancel() {
+	atomic.StoreInt32(&d.canceled, 1)
+	d.cancel()
+}
+
+// Pause suspends the transfer of a running download, without closing the
+// connection to the server, until Resume is called. While paused the
+// progress doesn't advance. The download may still be cancelled.
+func (d *Downloader) Pause() {
+	d.pauseLock.Lock()
+	defer d.pauseLock.Unlock()
+	if d.paused == nil {
+		d.paused = make(chan struct{})
+		d.pausedAt = time.Now()
+	}
+}
+
+// Resume restarts the transfer of a download suspended with Pause. The
+// ETA is checked against Config.MaxETA only after a new warm-up period, and
+// the time spent paused doesn't count toward Config.MaxBytesPerSecond.
+func (d *Downloader) Resume() {
+	d.pauseLock.Lock()
+	defer d.pauseLock.Unlock()
+	if d.paused != nil {
+		close(d.paused)
+		d.paused = nil
+		d.warmUpStart = time.Now()
+		d.throttle.skip(time.Since(d.pausedAt))
+	}
+}
+
+// Paused returns true if the download has been suspended with Pause.
+func (d *Downloader) Paused() bool {
+	d.pauseLock.Lock()
+	defer d.pauseLock.Unlock()
+	return d.paused != nil
+}
+
+// NotModified returns true if the download was skipped because the server
+// replied that the file didn't change since the last download (see
+// Config.SkipIfUnmodified).
+func (d *Downloader) NotModified() bool {
+	return d.notModified
+}
+
+// Path returns the path of the file being downloaded, or an empty string if
+// the download is not written to a file (see DownloadToWriter). With
+// Config.Atomic this is the staging file until the
+// download is committed to its final destination.
+func (d *Downloader) Path() string {
+	return d.path
+}
+
+// FileName returns the name of the file being downloaded, without the
+// directory (see DownloadToDir).
+func (d *Downloader) FileName() string {
+	if d.path == "" {
+		return ""
+	}
+	if d.commitPath != "" {
+		return filepath.Base(d.commitPath)
+	}
+	return filepath.Base(d.path)
+}
+
+// Header returns the headers of the response of the server.
+func (d *Downloader) Header() http.Header {
+	return d.Resp.Header
+}
+
+// FinalURL returns the url of the download after following the redirects.
+func (d *Downloader) FinalURL() string {
+	if d.Resp.Request == nil {
+		return d.URL
+	}
+	return d.Resp.Request.URL.String()
+}
+
+// Size return the size of the download, or -1 if the size is unknown (for
+// example when the server doesn't send the Content-Length header and
+// signals the end of the content by closing the connection).
 func (d *Downloader) Size() int64 {
+	d.completedLock.Lock()
+	defer d.completedLock.Unlock()
 	return d.size
 }
 
+// Progress returns the bytes read so far and the size of the download (or -1
+// if unknown), as a consistent pair.
+func (d *Downloader) Progress() (completed, total int64) {
+	d.completedLock.Lock()
+	defer d.completedLock.Unlock()
+	return d.completed, d.size
+}
+
 // RunAndPoll starts the downloader copy-loop and calls the poll function every
 // interval time to update progress.
 func (d *Downloader) RunAndPoll(poll func(current int64), interval time.Duration) error {
@@ -72,29 +232,377 @@ func (d *Downloader) RunAndPoll(poll func(current int64), interval time.Duration
 	}
 }
 
+// State is the state of a download
+type State int
+
+const (
+	// Running means that the download is in progress
+	Running State = iota
+	// Completed means that the download has been completed successfully
+	Completed
+	// Canceled means that the download has been canceled
+	Canceled
+	// Failed means that the download failed with an error
+	Failed
+)
+
+func (s State) String() string {
+	switch s {
+	case Running:
+		return "running"
+	case Completed:
+		return "completed"
+	case Canceled:
+		return "canceled"
+	case Failed:
+		return "failed"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// stateFromError returns the final state of a download ended with the
+// given error.
+func stateFromError(err error) State {
+	switch {
+	case err == nil:
+		return Completed
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return Canceled
+	default:
+		return Failed
+	}
+}
+
+// RunAndPollWithState is like RunAndPoll, but the poll function also
+// receives the state of the download: Running while the download is in
+// progress, and the final state (Completed, Canceled or Failed) on the last
+// call.
+func (d *Downloader) RunAndPollWithState(poll func(current int64, state State), interval time.Duration) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	go d.AsyncRun()
+	for {
+		select {
+		case <-t.C:
+			poll(d.Completed(), Running)
+		case <-d.Done:
+			err := d.Error()
+			poll(d.Completed(), stateFromError(err))
+			return err
+		}
+	}
+}
+
 // AsyncRun starts the downloader copy-loop. This function is supposed to be run
-// on his own go routine because it sends a confirmation on the Done channel
+// on his own go routine because it sends a confirmation on the Done channel.
+// The Done channel is buffered, so AsyncRun terminates even if nobody is
+// waiting for the confirmation.
 func (d *Downloader) AsyncRun() {
-	in := d.Resp.Body
-	buff := [4096]byte{}
+	if d.notModified {
+		_ = d.Close()
+		d.closeSubscribers()
+		d.warnings.close()
+		d.Done <- true
+		return
+	}
+	rate := d.rateEstimator()
+	d.pauseLock.Lock()
+	d.warmUpStart = time.Now()
+	d.throttle = newThrottle(d.config.MaxBytesPerSecond, d.config.RampUp)
+	d.pauseLock.Unlock()
+	rate.Observe(d.Completed(), time.Now())
+	stopReporters := d.startReporters()
+	d.err = d.startHashing()
+	if d.err == nil && !d.alreadyComplete {
+		if d.parallel != nil {
+			d.err = d.copyParallel(rate)
+		} else {
+			d.err = d.copy(rate)
+		}
+		if d.err == nil || errors.Is(d.err, io.ErrUnexpectedEOF) {
+			if completed, size := d.Progress(); size >= 0 && completed != size {
+				d.err = &ShortDownloadError{Expected: size, Got: completed}
+			}
+		}
+	}
+	if d.err != nil && atomic.LoadInt32(&d.canceled) == 1 && !errors.Is(d.err, context.Canceled) {
+		d.err = fmt.Errorf("%w: %s", context.Canceled, d.err)
+	}
+	verifyFailed := false
+	if d.err == nil {
+		d.err = d.verify()
+		verifyFailed = d.err != nil
+	}
+	if d.err == nil && d.config.OnClose != nil {
+		if f, ok := d.out.(*os.File); ok {
+			d.err = d.config.OnClose(f)
+		}
+	}
+	stopReporters()
+	_ = d.Close()
+	if d.err == ErrPrefixMismatch && d.path != "" {
+		_ = os.Remove(d.path)
+		_ = removeResumeMeta(d.path)
+	}
+	if d.err == nil && d.path != "" {
+		_ = removeResumeMeta(d.path)
+	}
+	if d.commitPath != "" {
+		if d.err == nil {
+			d.err = d.commit()
+		} else if verifyFailed {
+			// A download that failed verification can't be resumed
+			_ = os.Remove(d.path)
+			_ = removeResumeMeta(d.path)
+		}
+	}
+	if d.err == nil && d.config.PreserveModTime && d.path != "" {
+		d.err = d.preserveModTime()
+	}
+	if d.err == nil && d.config.SkipIfUnmodified && d.path != "" && !d.alreadyComplete {
+		if err := saveLastModified(d.path, d.Resp.Header.Get("Last-Modified")); err != nil {
+			d.config.logWarn("saving last modification time", "file", d.path, "error", err)
+		}
+	}
+	d.closeSubscribers()
+	d.warnings.close()
+	d.Done <- true
+}
+
+// copy is the downloader copy-loop
+func (d *Downloader) copy(rate RateEstimator) error {
+	in := d.currentBody()
+	buff := make([]byte, d.config.bufferSize())
+	var prefix []byte
+	checkPrefix := d.completed == 0 && len(d.config.ExpectedPrefix) > 0
+	connectedAt := time.Now()
+	retries := 0
+
+	// The progress is accumulated and published every
+	// Config.ProgressUpdateBytes
+	offset := d.Completed()
+	var pendingRead, pendingWritten int64
+	flush := func() {
+		if pendingRead == 0 && pendingWritten == 0 {
+			return
+		}
+		completed := d.addProgress(pendingRead, pendingWritten)
+		if pendingWritten > 0 {
+			rate.Observe(completed, time.Now())
+			d.notifySubscribers(completed)
+		}
+		pendingRead, pendingWritten = 0, 0
+	}
+	defer flush()
+
 	for {
-		n, err := in.Read(buff[:])
+		if err := d.waitAllowedWindow(); err != nil {
+			return err
+		}
+		if err := d.waitResumed(); err != nil {
+			return err
+		}
+		if age := d.config.MaxConnectionAge; age > 0 && time.Since(connectedAt) >= age {
+			flush()
+			if err := d.reconnect(); err != nil {
+				return err
+			}
+			in = d.body
+			connectedAt = time.Now()
+		}
+		n, err := in.Read(buff)
 		if n > 0 {
-			_, _ = d.out.Write(buff[:n])
-			d.completedLock.Lock()
-			d.completed += int64(n)
-			d.completedLock.Unlock()
+			pendingRead += int64(n)
+			if d.config.ProgressUpdateBytes <= 0 {
+				flush()
+			}
+		}
+		if checkPrefix && (n > 0 || err != nil) {
+			prefix = append(prefix, buff[:n]...)
+			if len(prefix) >= len(d.config.ExpectedPrefix) || err != nil {
+				if !bytes.HasPrefix(prefix, d.config.ExpectedPrefix) {
+					return ErrPrefixMismatch
+				}
+				checkPrefix = false
+			}
+		}
+		if n > 0 {
+			if err := d.config.checkMaxSize(offset + int64(n)); err != nil {
+				return err
+			}
+			written, err := d.out.Write(buff[:n])
+			if err == nil && written < n {
+				err = io.ErrShortWrite
+			}
+			if err != nil {
+				pendingWritten += int64(written)
+				return fmt.Errorf("writing output: %w", err)
+			}
+			for _, w := range d.config.ExtraWriters {
+				if _, err := w.Write(buff[:n]); err != nil {
+					pendingWritten += int64(n)
+					return fmt.Errorf("writing to extra writer: %w", err)
+				}
+			}
+			if d.config.VerifyWrites {
+				if err := d.verifyWrite(buff[:n], offset); err != nil {
+					return err
+				}
+			}
+			d.hash(buff[:n])
+			offset += int64(n)
+			pendingWritten += int64(n)
+			if pendingWritten >= d.config.ProgressUpdateBytes {
+				flush()
+			}
+			if err := d.checkETA(); err != nil {
+				return err
+			}
+			if err := d.throttle.wait(d.ctx, n); err != nil {
+				return err
+			}
 		}
 		if err == io.EOF {
-			break
+			return nil
 		}
 		if err != nil {
-			d.err = err
-			break
+			if ctxErr := d.ctx.Err(); ctxErr != nil && d.config.CancelFlushGrace > 0 {
+				return d.flushOnCancel(ctxErr)
+			}
+			if d.ctx.Err() != nil || retries >= d.config.MaxRetries || d.Resp.Uncompressed {
+				return err
+			}
+
+			// Resume the transfer from the bytes written so far, the
+			// progress continues from there
+			flush()
+			retries++
+			d.config.logWarn("transfer interrupted, retrying", "url", d.URL, "attempt", retries, "error", err)
+			reportWarning(d.ctx, fmt.Errorf("transfer from %s interrupted, retrying: %w", d.URL, err))
+			if err := sleep(d.ctx, d.config.retryDelay(retries)); err != nil {
+				return err
+			}
+			if err := d.reconnect(); err != nil {
+				return err
+			}
+			in = d.body
+			connectedAt = time.Now()
 		}
 	}
-	_ = d.Close()
-	d.Done <- true
+}
+
+// reconnect closes the current connection and resumes the download with a
+// new request from the bytes completed so far.
+func (d *Downloader) reconnect() error {
+	if d.Resp.Uncompressed {
+		return fmt.Errorf("reconnecting to %s: can't resume a decompressed download", d.URL)
+	}
+	validators := resumeMeta{
+		ETag:         d.Resp.Header.Get("ETag"),
+		LastModified: d.Resp.Header.Get("Last-Modified"),
+	}
+	_ = d.currentBody().Close()
+	resp, err := doRequest(d.ctx, d.client, d.URL, d.config, d.Completed(), validators.ifRange(), "")
+	if err != nil {
+		return fmt.Errorf("reconnecting to %s: %w", d.URL, err)
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		_ = resp.Body.Close()
+		return fmt.Errorf("reconnecting to %s: %w", d.URL, rangeError(resp))
+	}
+	// Resp is left untouched, since it may be read concurrently (for
+	// example by Header)
+	d.body = resp.Body
+	return nil
+}
+
+// currentBody returns the body of the response being downloaded.
+func (d *Downloader) currentBody() io.ReadCloser {
+	if d.body != nil {
+		return d.body
+	}
+	return d.Resp.Body
+}
+
+// preserveModTime sets the modification time of the downloaded file to the
+// Last-Modified time sent by the server, if any.
+func (d *Downloader) preserveModTime() error {
+	modTime, err := http.ParseTime(d.Resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return nil
+	}
+	if err := os.Chtimes(d.path, modTime, modTime); err != nil {
+		return fmt.Errorf("setting modification time of %s: %s", d.path, err)
+	}
+	return nil
+}
+
+// flushOnCancel flushes to disk the data received during the grace period
+// after the cancellation of the download (see Config.CancelFlushGrace).
+func (d *Downloader) flushOnCancel(ctxErr error) error {
+	if f, ok := d.out.(interface{ Sync() error }); ok {
+		if err := f.Sync(); err != nil {
+			return fmt.Errorf("flushing output: %w", err)
+		}
+	}
+	return ctxErr
+}
+
+// verifyWrite reads back the data just written at the given offset of the
+// output, and compares it with the expected data. The check is skipped if
+// the output doesn't support reading.
+func (d *Downloader) verifyWrite(data []byte, offset int64) error {
+	ra, ok := d.out.(io.ReaderAt)
+	if !ok {
+		return nil
+	}
+	written := make([]byte, len(data))
+	if _, err := ra.ReadAt(written, offset); err != nil {
+		return fmt.Errorf("reading back written data: %s", err)
+	}
+	if !bytes.Equal(written, data) {
+		return fmt.Errorf("%w at offset %d", ErrWriteVerificationFailed, offset)
+	}
+	return nil
+}
+
+// allowedWindowPollInterval is the interval used to check again the
+// Config.AllowedWindow function while the download is paused.
+var allowedWindowPollInterval = time.Second
+
+// waitResumed blocks while the download is paused, until it's resumed or
+// the download context is cancelled.
+func (d *Downloader) waitResumed() error {
+	d.pauseLock.Lock()
+	paused := d.paused
+	d.pauseLock.Unlock()
+	if paused == nil {
+		return nil
+	}
+	select {
+	case <-d.ctx.Done():
+		return d.ctx.Err()
+	case <-paused:
+		return nil
+	}
+}
+
+// waitAllowedWindow blocks until the Config.AllowedWindow function allows
+// the transfer or the download context is cancelled.
+func (d *Downloader) waitAllowedWindow() error {
+	allowed := d.config.AllowedWindow
+	if allowed == nil {
+		return nil
+	}
+	for !allowed(time.Now()) {
+		select {
+		case <-d.ctx.Done():
+			return d.ctx.Err()
+		case <-time.After(allowedWindowPollInterval):
+		}
+	}
+	return nil
 }
 
 // Run starts the downloader and waits until it completes the download.
@@ -104,12 +612,31 @@ func (d *Downloader) Run() error {
 	return d.Error()
 }
 
+// RunWithTimeout starts the downloader and waits until it completes the
+// download. If the download takes longer than timeout it's aborted, keeping
+// the partial file, and an error wrapping os.ErrDeadlineExceeded is returned.
+func (d *Downloader) RunWithTimeout(timeout time.Duration) error {
+	var timedOut int32
+	t := time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&timedOut, 1)
+		d.cancel()
+	})
+	err := d.Run()
+	t.Stop()
+	if err != nil && atomic.LoadInt32(&timedOut) == 1 {
+		return fmt.Errorf("download not completed in %s: %w", timeout, os.ErrDeadlineExceeded)
+	}
+	return err
+}
+
 // Error returns the error during download or nil if no errors happened
 func (d *Downloader) Error() error {
 	return d.err
 }
 
-// Completed returns the bytes read so far
+// Completed returns the bytes read so far. It includes the bytes of the
+// partial file that has been resumed and never decreases, even when the
+// transfer is resumed after a retry.
 func (d *Downloader) Completed() int64 {
 	d.completedLock.Lock()
 	res := d.completed
@@ -117,9 +644,33 @@ func (d *Downloader) Completed() int64 {
 	return res
 }
 
+// Downloaded returns the bytes received from the network so far, including
+// the bytes of the partial file that has been resumed. It may be greater
+// than Written while a block of data is being written to the output.
+func (d *Downloader) Downloaded() int64 {
+	d.completedLock.Lock()
+	res := d.downloaded
+	d.completedLock.Unlock()
+	return res
+}
+
+// NetworkBytes returns the bytes received from the network so far by this
+// download, excluding the bytes of the partial file that has been resumed.
+func (d *Downloader) NetworkBytes() int64 {
+	return d.Downloaded() - d.resumedBytes
+}
+
+// Written returns the bytes written to the output so far. It's the same as
+// Completed.
+func (d *Downloader) Written() int64 {
+	return d.Completed()
+}
+
 // Download returns an asynchronous downloader that will download the specified url
 // in the specified file. A download resume is tried if a file shorter than the requested
-// url is already present.
+// url is already present. Urls with the "file" scheme (file:///path/to/file)
+// are copied from the local filesystem, like they were served by an HTTP
+// server, if enabled with Config.AllowFileURLs.
 func Download(file string, reqURL string, options ...DownloadOptions) (*Downloader, error) {
 	return DownloadWithConfig(file, reqURL, GetDefaultConfig(), options...)
 }
@@ -132,57 +683,519 @@ func DownloadWithConfig(file string, reqURL string, config Config, options ...Do
 	return DownloadWithConfigAndContext(context.Background(), file, reqURL, config, options...)
 }
 
+// Fetch downloads the specified url into the specified file and waits
+// until the download is completed and verified with the configured checksums.
+// It's a shortcut for DownloadWithConfigAndContext followed by Run.
+func Fetch(ctx context.Context, file string, reqURL string, config Config, options ...DownloadOptions) error {
+	d, err := DownloadWithConfigAndContext(ctx, file, reqURL, config, options...)
+	if err != nil {
+		return err
+	}
+	return d.Run()
+}
+
 // DownloadWithConfigAndContext applies an additional configuration to the http client and
 // returns an asynchronous downloader that will download the specified url
 // in the specified file. A download resume is tried if a file shorter than the requested
 // url is already present. The download can be cancelled using the provided context.
 func DownloadWithConfigAndContext(ctx context.Context, file string, reqURL string, config Config, options ...DownloadOptions) (*Downloader, error) {
-	noResume := false
+	ctx, cancel := context.WithCancel(withWarnings(ctx))
+	d, err := download(ctx, file, reqURL, config, options...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	d.cancel = cancel
+	return d, nil
+}
+
+func download(ctx context.Context, file string, reqURL string, config Config, options ...DownloadOptions) (*Downloader, error) {
+	noResume := config.NoResume
 	for _, opt := range options {
 		if opt == NoResume {
 			noResume = true
 		}
 	}
-	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
 
-	if err != nil {
-		return nil, fmt.Errorf("setting up HTTP request: %s", err)
+	target := file
+	if config.Atomic || config.CommitOnlyAfterVerification {
+		file = target + ".download"
+	}
+	client := config.httpClient()
+	validator := ""
+	if config.ValidatorInFilename {
+		_, etag, err := remoteSize(ctx, client, reqURL, config)
+		if err != nil {
+			return nil, err
+		}
+		if etag != "" && !strings.HasPrefix(etag, "W/") {
+			validator = etag
+		} else {
+			// The partial download can't be validated
+			noResume = true
+		}
+		file = partialPath(target, validator)
+		removeStalePartials(target, file)
+	}
+	if err := config.checkSymlink(target); err != nil {
+		return nil, err
+	}
+	if err := config.checkSymlink(file); err != nil {
+		return nil, err
+	}
+
+	// A complete download is checked with If-Modified-Since, instead of
+	// being resumed
+	lastModified := ""
+	if config.SkipIfUnmodified {
+		if _, err := os.Stat(target); err == nil {
+			lastModified = loadLastModified(target)
+		}
 	}
 
 	var completed int64
-	if !noResume {
+	if !noResume && lastModified == "" {
 		if info, err := os.Stat(file); err == nil {
 			completed = info.Size()
-			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", completed))
 		}
 	}
+	if completed > 0 {
+		if meta := loadResumeMeta(file); meta != nil && meta.URL != "" && meta.URL != reqURL {
+			// The partial download is of another url
+			completed = 0
+		}
+	}
+
+	if completed > 0 && config.OffsetHeader != "" {
+		offset, err := serverOffset(ctx, client, reqURL, config)
+		if err != nil {
+			return nil, err
+		}
+		if offset >= 0 && offset < completed {
+			if err := os.Truncate(file, offset); err != nil {
+				return nil, fmt.Errorf("truncating %s to resume offset: %s", file, err)
+			}
+			completed = offset
+		}
+	}
+
+	var headResp *http.Response
+	if config.UseHEAD {
+		var err error
+		if headResp, err = head(ctx, client, reqURL, config); err != nil {
+			return nil, err
+		}
+	} else if config.StrictRedirectConsistency {
+		// The consistency check is skipped if the HEAD request fails
+		var err error
+		var statusErr *HTTPStatusError
+		if headResp, err = head(ctx, client, reqURL, config); err != nil && !errors.As(err, &statusErr) {
+			return nil, err
+		}
+	}
+	if config.UseHEAD && headResp != nil {
+		// A rejected download is stopped before fetching any data
+		if err := checkResponse(config, headResp); err != nil {
+			return nil, err
+		}
+	}
+	preflightURL := ""
+	if config.StrictRedirectConsistency && headResp != nil && headResp.StatusCode < 300 {
+		preflightURL = headResp.Request.URL.String()
+	}
 
-	resp, err := config.HttpClient.Do(req)
+	ifRange := validator
+	if completed > 0 && ifRange == "" {
+		if meta := loadResumeMeta(file); meta != nil {
+			ifRange = meta.ifRange()
+		}
+	}
+
+	headSize := int64(-1)
+	if config.UseHEAD && headResp != nil {
+		headSize = headResp.ContentLength
+		if headResp.Header.Get("Content-Encoding") != "" {
+			headSize = -1
+		}
+		etag := headResp.Header.Get("ETag")
+		if completed > 0 && ifRange == "" && etag != "" && !strings.HasPrefix(etag, "W/") {
+			ifRange = etag
+		}
+		if completed > 0 && (headResp.Header.Get("Accept-Ranges") == "none" || (headSize >= 0 && completed > headSize)) {
+			// The partial download can't be resumed
+			completed = 0
+		}
+		if headSize >= 0 && completed < headSize {
+			if err := config.checkFreeSpace(file, headSize-completed); err != nil {
+				return nil, err
+			}
+			if err := config.checkMaxSize(headSize); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	resp, err := doRequest(ctx, client, reqURL, config, completed, ifRange, lastModified)
 	if err != nil {
 		return nil, err
 	}
 
-	// TODO: if file size == header size return nil, nil
+	if preflightURL != "" && resp.Request.URL.String() != preflightURL {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("%w: %s redirected to %s, then to %s", ErrRedirectChanged, reqURL, preflightURL, resp.Request.URL)
+	}
+
+	if lastModified != "" && resp.StatusCode == http.StatusNotModified {
+		_ = resp.Body.Close()
+		d := newDownloader(ctx, client, reqURL, config, resp, 0)
+		d.path = target
+		d.size = -1
+		if info, err := os.Stat(target); err == nil {
+			d.completed = info.Size()
+			d.size = info.Size()
+		}
+		d.alreadyComplete = true
+		d.notModified = true
+		return d, nil
+	}
+
+	if completed > 0 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// The requested range starts at (or after) the end of the remote file.
+		remoteSize := parseContentRangeSize(resp.Header.Get("Content-Range"))
+		_ = resp.Body.Close()
+		complete := remoteSize == completed
+		if complete && config.CompleteCheck != nil && !config.AppendMode {
+			complete, err = config.CompleteCheck(file, remoteSize, resp.Header.Get("ETag"))
+			if err != nil {
+				return nil, fmt.Errorf("checking if %s is complete: %s", file, err)
+			}
+		}
+		if complete && config.CompleteValidator != nil && !config.AppendMode {
+			complete, err = config.CompleteValidator(file, resp)
+			if err != nil {
+				return nil, fmt.Errorf("checking if %s is complete: %s", file, err)
+			}
+		}
+		if complete {
+			d := newDownloader(ctx, client, reqURL, config, resp, completed)
+			d.path = file
+			d.size = completed
+			d.alreadyComplete = true
+			if file != target {
+				d.commitPath = target
+			}
+			return d, nil
+		}
+
+		// The local file is not a valid partial download, start from scratch
+		completed = 0
+		resp, err = doRequest(ctx, client, reqURL, config, completed, "", "")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if completed > 0 && resp.StatusCode == http.StatusOK {
+		// The server ignored the Range header, or the remote file changed
+		// since the partial download (If-Range), and is sending the whole
+		// file: restart the download from scratch.
+		completed = 0
+	}
+
+	if err := checkResponse(config, resp); err != nil {
+		_ = resp.Body.Close()
+		return nil, err
+	}
+	if err := decodeBody(config, resp, file); err != nil {
+		_ = resp.Body.Close()
+		return nil, err
+	}
+	if err := config.checkFreeSpace(file, resp.ContentLength); err != nil {
+		_ = resp.Body.Close()
+		return nil, err
+	}
+	if resp.ContentLength >= 0 {
+		if err := config.checkMaxSize(completed + resp.ContentLength); err != nil {
+			_ = resp.Body.Close()
+			return nil, err
+		}
+	}
+
+	if completed == 0 && config.BackupExisting && file == target {
+		if _, err := os.Stat(file); err == nil {
+			if err := os.Rename(file, file+".bak"); err != nil {
+				_ = resp.Body.Close()
+				return nil, fmt.Errorf("backing up %s: %s", file, err)
+			}
+		}
+	}
 
 	flags := os.O_WRONLY
+	if config.VerifyWrites {
+		flags = os.O_RDWR
+	}
 	if completed == 0 {
 		flags |= os.O_CREATE | os.O_TRUNC
 	} else {
 		flags |= os.O_APPEND
 	}
-	f, err := os.OpenFile(file, flags, 0644)
+	f, err := config.openFile(file, flags, completed > 0)
 	if err != nil {
 		_ = resp.Body.Close()
 		return nil, fmt.Errorf("opening %s for writing: %s", file, err)
 	}
 
-	d := &Downloader{
-		URL:       reqURL,
-		Done:      make(chan bool),
-		Resp:      resp,
-		out:       f,
-		completed: completed,
-		size:      resp.ContentLength + completed,
+	if !config.ValidatorInFilename {
+		if err := saveResumeMeta(file, reqURL, resp); err != nil {
+			config.logWarn("saving resume validators", "file", file, "error", err)
+		}
+	}
+	if config.SkipIfUnmodified {
+		// The destination is going to be replaced
+		_ = removeLastModified(target)
+	}
+
+	d := newDownloader(ctx, client, reqURL, config, resp, completed)
+	if d.size < 0 && headSize >= 0 && !resp.Uncompressed && resp.Header.Get("Content-Encoding") == "" {
+		// The size is known from the HEAD request
+		d.size = headSize
+	}
+	d.out = f
+	d.outCloser = f
+	d.path = file
+	if file != target {
+		d.commitPath = target
 	}
 	return d, nil
 }
+
+// commit moves a verified download from the staging file to its final
+// destination (see Config.Atomic).
+func (d *Downloader) commit() error {
+	if d.config.BackupExisting {
+		if _, err := os.Stat(d.commitPath); err == nil {
+			if err := os.Rename(d.commitPath, d.commitPath+".bak"); err != nil {
+				return fmt.Errorf("backing up %s: %s", d.commitPath, err)
+			}
+		}
+	}
+	if err := os.Rename(d.path, d.commitPath); err != nil {
+		return fmt.Errorf("committing %s: %s", d.commitPath, err)
+	}
+	d.path = d.commitPath
+	return nil
+}
+
+// DownloadToWriter returns an asynchronous downloader that will download the
+// specified url into the given writer. Since the content already written to
+// an arbitrary writer is unknown, resume is not possible and the NoResume
+// option is implied. The writer is not closed at the end of the download.
+// If w is os.Stdout and Config.ProgressOutput is also os.Stdout, the progress
+// is rendered on os.Stderr to avoid corrupting the downloaded stream.
+func DownloadToWriter(w io.Writer, reqURL string, config Config) (*Downloader, error) {
+	return DownloadToWriterWithContext(context.Background(), w, reqURL, config)
+}
+
+// DownloadToWriterWithContext is like DownloadToWriter, but the download can
+// be cancelled using the provided context.
+func DownloadToWriterWithContext(ctx context.Context, w io.Writer, reqURL string, config Config) (*Downloader, error) {
+	if w == os.Stdout && config.ProgressOutput == os.Stdout {
+		config.ProgressOutput = os.Stderr
+	}
+	ctx, cancel := context.WithCancel(withWarnings(ctx))
+	client := config.httpClient()
+	resp, err := doRequest(ctx, client, reqURL, config, 0, "", "")
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if err := checkResponse(config, resp); err != nil {
+		_ = resp.Body.Close()
+		cancel()
+		return nil, err
+	}
+	if err := decodeBody(config, resp, resp.Request.URL.Path); err != nil {
+		_ = resp.Body.Close()
+		cancel()
+		return nil, err
+	}
+	d := newDownloader(ctx, client, reqURL, config, resp, 0)
+	d.out = w
+	d.cancel = cancel
+	return d, nil
+}
+
+// newDownloader creates a Downloader for the given response, that continues
+// a download that already completed the specified amount of bytes.
+func newDownloader(ctx context.Context, client *http.Client, reqURL string, config Config, resp *http.Response, completed int64) *Downloader {
+	size := int64(-1)
+	if resp.ContentLength >= 0 {
+		size = resp.ContentLength + completed
+	}
+	return &Downloader{
+		URL:           reqURL,
+		Done:          make(chan bool, 1),
+		Resp:          resp,
+		completed:     completed,
+		downloaded:    completed,
+		setupDuration: setupDuration(resp),
+		warnings:      warningsFrom(ctx),
+		resumed:       completed > 0,
+		resumedBytes:  completed,
+		size:          size,
+		config:        config,
+		ctx:           ctx,
+		client:        client,
+	}
+}
+
+// doRequestOnce sends the GET request for the given url, asking for the
+// content starting at the specified offset.
+func doRequestOnce(ctx context.Context, client *http.Client, reqURL string, config Config, offset int64, ifRange, ifModifiedSince string) (*http.Response, error) {
+	if config.CancelFlushGrace > 0 {
+		ctx = withGrace(ctx, config.CancelFlushGrace)
+	}
+	req, err := newRequest(withRequestTiming(ctx), "GET", reqURL, config)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		if config.RangeHeaderFunc != nil {
+			name, value := config.RangeHeaderFunc(offset)
+			req.Header.Set(name, value)
+		} else {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+		if ifRange != "" {
+			req.Header.Set("If-Range", ifRange)
+		}
+	} else if ifModifiedSince != "" {
+		req.Header.Set("If-Modified-Since", ifModifiedSince)
+	}
+	if config.DisableCompression {
+		req.Header.Set("Accept-Encoding", "identity")
+	} else if config.SmartDecompress || config.Decompress {
+		// Handle the decompression explicitly. Ranges of encoded content can't
+		// be appended to decoded content, so resumed downloads ask for the
+		// content without encoding.
+		if offset > 0 {
+			req.Header.Set("Accept-Encoding", "identity")
+		} else {
+			req.Header.Set("Accept-Encoding", "gzip")
+		}
+	}
+	return client.Do(req)
+}
+
+// serverOffset asks the server, with a HEAD request, the offset from which
+// the download should be resumed, as reported in the Config.OffsetHeader
+// response header. It returns -1 if the server doesn't report it.
+func serverOffset(ctx context.Context, client *http.Client, reqURL string, config Config) (int64, error) {
+	resp, err := head(ctx, client, reqURL, config)
+	if err != nil || resp == nil {
+		return -1, err
+	}
+	value := resp.Header.Get(config.OffsetHeader)
+	if value == "" {
+		return -1, nil
+	}
+	offset, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || offset < 0 {
+		return 0, fmt.Errorf("invalid %s header: %q", config.OffsetHeader, value)
+	}
+	return offset, nil
+}
+
+// withGrace returns a context that is cancelled after the grace period
+// since the cancellation of ctx.
+func withGrace(ctx context.Context, grace time.Duration) context.Context {
+	graceCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	context.AfterFunc(ctx, func() { time.AfterFunc(grace, cancel) })
+	return graceCtx
+}
+
+// defaultTraceHeader is the header used to send Config.TraceID if
+// Config.TraceHeader is not set.
+const defaultTraceHeader = "X-Request-ID"
+
+// newRequest creates an HTTP request with the headers required by the
+// configuration.
+func newRequest(ctx context.Context, method, reqURL string, config Config) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, reqURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("setting up HTTP request: %s", err)
+	}
+	if err := config.checkHost(req.URL); err != nil {
+		return nil, err
+	}
+	if config.CacheKey != "" {
+		req.Header.Set("X-Cache-Key", config.CacheKey)
+	}
+	if config.TraceID != "" {
+		header := config.TraceHeader
+		if header == "" {
+			header = defaultTraceHeader
+		}
+		req.Header.Set(header, config.TraceID)
+	}
+	for _, cookie := range config.Cookies {
+		req.AddCookie(cookie)
+	}
+	if config.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+config.BearerToken)
+	} else if auth := config.BasicAuth; auth != nil {
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+	return req, nil
+}
+
+// checkResponse returns an error if the server replied with an error status
+// or if the response is not accepted by Config.AcceptFunc.
+func checkResponse(config Config, resp *http.Response) error {
+	if resp.StatusCode >= 400 {
+		return &HTTPStatusError{Code: resp.StatusCode, Status: resp.Status}
+	}
+	if config.AcceptFunc != nil {
+		if err := config.AcceptFunc(resp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// head sends a HEAD request for the given url. The returned response is
+// nil if the server doesn't support HEAD requests (405 or 501 status
+// codes), and any other error status is returned as an *HTTPStatusError.
+func head(ctx context.Context, client *http.Client, reqURL string, config Config) (*http.Response, error) {
+	req, err := newRequest(ctx, "HEAD", reqURL, config)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented {
+		return nil, nil
+	}
+	if resp.StatusCode >= 400 {
+		return nil, &HTTPStatusError{Code: resp.StatusCode, Status: resp.Status}
+	}
+	return resp, nil
+}
+
+// parseContentRangeSize returns the complete length of the resource from a
+// Content-Range header value (for example "bytes 0-99/1234" or "bytes */1234"),
+// or -1 if the length is unknown or the header is invalid.
+func parseContentRangeSize(contentRange string) int64 {
+	i := strings.LastIndex(contentRange, "/")
+	if i == -1 {
+		return -1
+	}
+	size, err := strconv.ParseInt(contentRange[i+1:], 10, 64)
+	if err != nil || size < 0 {
+		return -1
+	}
+	return size
+}
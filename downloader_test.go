@@ -7,12 +7,33 @@
 package downloader
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -28,6 +49,29 @@ func makeTmpFile(t *testing.T) string {
 	return tmpFile
 }
 
+// newTestFileServer starts a local server that serves testdata/test.txt
+// at /test.txt, with support for Range requests.
+func newTestFileServer(t *testing.T) *httptest.Server {
+	data, err := os.ReadFile("testdata/test.txt")
+	require.NoError(t, err)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/test.txt", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"test"`)
+		http.ServeContent(w, r, "test.txt", time.Time{}, bytes.NewReader(data))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func requireSameAsTestFile(t *testing.T, file string) {
+	file1, err := os.ReadFile("testdata/test.txt")
+	require.NoError(t, err)
+	file2, err := os.ReadFile(file)
+	require.NoError(t, err)
+	require.Equal(t, file1, file2)
+}
+
 func TestDownload(t *testing.T) {
 	tmpFile := makeTmpFile(t)
 	defer os.Remove(tmpFile)
@@ -219,3 +263,4030 @@ func TestContextCancelation(t *testing.T) {
 
 	require.NoError(t, server.Shutdown(ctx))
 }
+
+func TestAllowedWindow(t *testing.T) {
+	server := newTestFileServer(t)
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	defer func(prev time.Duration) { allowedWindowPollInterval = prev }(allowedWindowPollInterval)
+	allowedWindowPollInterval = 10 * time.Millisecond
+
+	// The window is open for the first read, then closes for 300ms
+	var closedAt time.Time
+	config := Config{
+		AllowedWindow: func(now time.Time) bool {
+			if closedAt.IsZero() {
+				closedAt = now
+				return true
+			}
+			return now.Sub(closedAt) > 300*time.Millisecond
+		},
+	}
+
+	start := time.Now()
+	d, err := DownloadWithConfig(tmpFile, server.URL+"/test.txt", config)
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	require.True(t, time.Since(start) >= 300*time.Millisecond)
+	require.Equal(t, int64(8052), d.Completed())
+	requireSameAsTestFile(t, tmpFile)
+}
+
+func TestExpectedPrefix(t *testing.T) {
+	server := newTestFileServer(t)
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	d, err := DownloadWithConfig(tmpFile, server.URL+"/test.txt", Config{ExpectedPrefix: []byte("\x7fELF")})
+	require.NoError(t, err)
+	require.Equal(t, ErrPrefixMismatch, d.Run())
+	_, err = os.Stat(tmpFile)
+	require.True(t, os.IsNotExist(err))
+
+	d, err = DownloadWithConfig(tmpFile, server.URL+"/test.txt", Config{ExpectedPrefix: []byte("Hey! You")})
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	requireSameAsTestFile(t, tmpFile)
+}
+
+func TestUnknownSizeWithConnectionClose(t *testing.T) {
+	data, err := os.ReadFile("testdata/test.txt")
+	require.NoError(t, err)
+
+	// HTTP/1.0 style server: no Content-Length, the end of the body is
+	// signaled by closing the connection.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+				_ = conn.Close()
+				continue
+			}
+			_, _ = conn.Write([]byte("HTTP/1.0 200 OK\r\nContent-Type: text/plain\r\n\r\n"))
+			_, _ = conn.Write(data)
+			_ = conn.Close()
+		}
+	}()
+
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	d, err := Download(tmpFile, "http://"+listener.Addr().String()+"/test.txt")
+	require.NoError(t, err)
+	require.Equal(t, int64(-1), d.Size())
+	require.NoError(t, d.Run())
+	require.Equal(t, int64(8052), d.Completed())
+	require.Equal(t, int64(-1), d.Size())
+	requireSameAsTestFile(t, tmpFile)
+}
+
+func TestSubscribeWithBlockedSubscriber(t *testing.T) {
+	chunk := bytes.Repeat([]byte("0123456789abcdef"), 256)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprint(len(chunk)*256))
+		for i := 0; i < 256; i++ {
+			_, _ = w.Write(chunk)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer server.Close()
+
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	d, err := Download(tmpFile, server.URL)
+	require.NoError(t, err)
+	latest := d.Subscribe(0)
+	buffered := d.Subscribe(4)
+
+	// Nobody reads from the channels until the download is completed: the
+	// copy-loop must not be stalled by the subscribers.
+	done := make(chan error)
+	go func() { done <- d.Run() }()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		require.FailNow(t, "download stalled by subscribers")
+	}
+
+	require.Equal(t, 1, cap(latest))
+	require.Equal(t, 4, cap(buffered))
+	values := []int64{}
+	for v := range latest {
+		values = append(values, v)
+	}
+	require.Equal(t, []int64{d.Completed()}, values)
+	values = []int64{}
+	for v := range buffered {
+		values = append(values, v)
+	}
+	require.Len(t, values, 4)
+	require.Equal(t, d.Completed(), values[3])
+
+	// Subscribing after the end returns a closed channel
+	_, ok := <-d.Subscribe(0)
+	require.False(t, ok)
+}
+
+func TestResumeOnAlreadyCompletedFile(t *testing.T) {
+	server := newTestFileServer(t)
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	data, err := os.ReadFile("testdata/test.txt")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(tmpFile, data, 0644))
+
+	d, err := Download(tmpFile, server.URL+"/test.txt")
+	require.NoError(t, err)
+	require.Equal(t, int64(8052), d.Completed())
+	require.Equal(t, int64(8052), d.Size())
+	require.NoError(t, d.Run())
+	require.Equal(t, int64(8052), d.Completed())
+	requireSameAsTestFile(t, tmpFile)
+}
+
+func TestCompleteCheckForcesDownload(t *testing.T) {
+	server := newTestFileServer(t)
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	// Same size of the remote file, but different content
+	require.NoError(t, os.WriteFile(tmpFile, make([]byte, 8052), 0644))
+
+	checked := false
+	config := Config{
+		CompleteCheck: func(path string, remoteSize int64, remoteETag string) (bool, error) {
+			require.Equal(t, tmpFile, path)
+			require.Equal(t, int64(8052), remoteSize)
+			require.Equal(t, `"test"`, remoteETag)
+			checked = true
+			return false, nil
+		},
+	}
+	d, err := DownloadWithConfig(tmpFile, server.URL+"/test.txt", config)
+	require.NoError(t, err)
+	require.True(t, checked)
+	require.Equal(t, int64(0), d.Completed())
+	require.NoError(t, d.Run())
+	requireSameAsTestFile(t, tmpFile)
+}
+
+func TestCompleteValidatorForcesDownload(t *testing.T) {
+	server := newTestFileServer(t)
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	// Same size of the remote file, but different content
+	require.NoError(t, os.WriteFile(tmpFile, make([]byte, 8052), 0644))
+
+	checked := false
+	config := Config{
+		CompleteValidator: func(path string, resp *http.Response) (bool, error) {
+			require.Equal(t, tmpFile, path)
+			require.Equal(t, `"test"`, resp.Header.Get("ETag"))
+			checked = true
+			return false, nil
+		},
+	}
+	d, err := DownloadWithConfig(tmpFile, server.URL+"/test.txt", config)
+	require.NoError(t, err)
+	require.True(t, checked)
+	require.Equal(t, int64(0), d.Completed())
+	require.NoError(t, d.Run())
+	requireSameAsTestFile(t, tmpFile)
+
+	// The validator accepts the complete file
+	config.CompleteValidator = func(path string, resp *http.Response) (bool, error) {
+		return true, nil
+	}
+	d, err = DownloadWithConfig(tmpFile, server.URL+"/test.txt", config)
+	require.NoError(t, err)
+	require.Equal(t, int64(8052), d.Completed())
+	require.NoError(t, d.Run())
+	requireSameAsTestFile(t, tmpFile)
+}
+
+type fixedRateEstimator struct {
+	observed int64
+	calls    int
+}
+
+func (e *fixedRateEstimator) Observe(bytes int64, at time.Time) {
+	e.observed = bytes
+	e.calls++
+}
+
+func (e *fixedRateEstimator) BytesPerSecond() float64 {
+	return 42
+}
+
+func (e *fixedRateEstimator) ETA(remaining int64) time.Duration {
+	return time.Duration(remaining) * time.Second / 42
+}
+
+func TestCustomRateEstimator(t *testing.T) {
+	server := newTestFileServer(t)
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	estimator := &fixedRateEstimator{}
+	d, err := DownloadWithConfig(tmpFile, server.URL+"/test.txt", Config{RateEstimator: estimator})
+	require.NoError(t, err)
+	require.Equal(t, 8052*time.Second/42, d.ETA())
+	require.NoError(t, d.Run())
+	require.True(t, estimator.calls > 1)
+	require.Equal(t, int64(8052), estimator.observed)
+	require.Equal(t, float64(42), d.BytesPerSecond())
+	require.Equal(t, time.Duration(0), d.ETA())
+}
+
+func TestEMARateEstimator(t *testing.T) {
+	e := NewEMARateEstimator(0.5)
+	start := time.Now()
+	require.Equal(t, float64(0), e.BytesPerSecond())
+	require.Equal(t, time.Duration(0), e.ETA(1000))
+	e.Observe(0, start)
+	e.Observe(1000, start.Add(time.Second))
+	require.Equal(t, float64(1000), e.BytesPerSecond())
+	e.Observe(4000, start.Add(2*time.Second))
+	require.Equal(t, float64(2000), e.BytesPerSecond())
+	require.Equal(t, 5*time.Second, e.ETA(10000))
+}
+
+func TestResumeWithRotatedSignedURL(t *testing.T) {
+	data, err := os.ReadFile("testdata/test.txt")
+	require.NoError(t, err)
+
+	// Each request to /file redirects to a new signed URL, invalidating the
+	// previous ones.
+	signature := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file", func(w http.ResponseWriter, r *http.Request) {
+		signature++
+		http.Redirect(w, r, fmt.Sprintf("/signed?sig=%d", signature), http.StatusFound)
+	})
+	mux.HandleFunc("/signed", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("sig") != fmt.Sprint(signature) {
+			http.Error(w, "expired signature", http.StatusForbidden)
+			return
+		}
+		http.ServeContent(w, r, "test.txt", time.Time{}, bytes.NewReader(data))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	// First (interrupted) download
+	d, err := Download(tmpFile, server.URL+"/file")
+	require.NoError(t, err)
+	staleURL := d.Resp.Request.URL.String()
+	require.NoError(t, d.Close())
+	defer os.Remove(metaPath(tmpFile))
+	// The original url is saved, not the signed one
+	require.Equal(t, server.URL+"/file", loadResumeMeta(tmpFile).URL)
+	part, err := os.ReadFile("testdata/test.txt.part")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(tmpFile, part, 0644))
+
+	// Resume obtains a fresh signed URL
+	d, err = Download(tmpFile, server.URL+"/file")
+	require.NoError(t, err)
+	require.Equal(t, server.URL+"/file", d.URL)
+	require.NotEqual(t, staleURL, d.Resp.Request.URL.String())
+	require.Equal(t, int64(3506), d.Completed())
+	require.NoError(t, d.Run())
+	requireSameAsTestFile(t, tmpFile)
+
+	resp, err := http.Get(staleURL)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// The partial download of another url is not resumed
+	d, err = Download(tmpFile, server.URL+"/file", NoResume)
+	require.NoError(t, err)
+	require.NoError(t, d.Close())
+	require.NoError(t, os.WriteFile(tmpFile, part, 0644))
+	d, err = Download(tmpFile, server.URL+"/file?mirror=2")
+	require.NoError(t, err)
+	require.Zero(t, d.Completed())
+	require.NoError(t, d.Run())
+	requireSameAsTestFile(t, tmpFile)
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use
+type syncBuffer struct {
+	lock sync.Mutex
+	buff bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buff.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buff.String()
+}
+
+// newSlowServer starts a server that sends the given number of chunks of
+// 1000 bytes, waiting delay between each chunk.
+func newSlowServer(t *testing.T, chunks int, delay time.Duration) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprint(chunks*1000))
+		for i := 0; i < chunks; i++ {
+			if _, err := w.Write(bytes.Repeat([]byte{'a'}, 1000)); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			time.Sleep(delay)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestMaxETA(t *testing.T) {
+	server := newSlowServer(t, 30, 50*time.Millisecond)
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	config := Config{MaxETA: 200 * time.Millisecond, MaxETAWarmUp: 300 * time.Millisecond}
+	d, err := DownloadWithConfig(tmpFile, server.URL, config)
+	require.NoError(t, err)
+	err = d.Run()
+	require.True(t, errors.Is(err, ErrETAExceeded))
+	require.Equal(t, Failed, stateFromError(err))
+
+	// The partial download is kept
+	info, err := os.Stat(tmpFile)
+	require.NoError(t, err)
+	require.True(t, info.Size() > 0)
+	require.True(t, info.Size() < 30000)
+	require.Equal(t, d.Completed(), info.Size())
+}
+
+func TestPauseAndResume(t *testing.T) {
+	server := newSlowServer(t, 20, 20*time.Millisecond)
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	d, err := DownloadWithConfig(tmpFile, server.URL, Config{})
+	require.NoError(t, err)
+	go d.AsyncRun()
+	time.Sleep(100 * time.Millisecond)
+	d.Pause()
+	require.True(t, d.Paused())
+	time.Sleep(100 * time.Millisecond)
+	paused := d.Completed()
+	time.Sleep(time.Second)
+	require.Equal(t, paused, d.Completed())
+	require.True(t, paused < 20000)
+
+	d.Resume()
+	require.False(t, d.Paused())
+	<-d.Done
+	require.NoError(t, d.Error())
+	require.Equal(t, int64(20000), d.Completed())
+}
+
+func TestProgressChan(t *testing.T) {
+	server := newSlowServer(t, 20, 20*time.Millisecond)
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	d, err := DownloadWithConfig(tmpFile, server.URL, Config{MinPollInterval: 100 * time.Millisecond})
+	require.NoError(t, err)
+	progress := d.ProgressChan()
+	go d.AsyncRun()
+	values := []int64{}
+	for completed := range progress {
+		values = append(values, completed)
+	}
+	<-d.Done
+	require.NoError(t, d.Error())
+	require.NotEmpty(t, values)
+	require.True(t, len(values) < 20)
+	for i := 1; i < len(values); i++ {
+		require.True(t, values[i] > values[i-1])
+	}
+	require.Equal(t, int64(20000), values[len(values)-1])
+
+	// A consumer that doesn't drain the channel doesn't block the download
+	require.NoError(t, os.Remove(tmpFile))
+	d, err = DownloadWithConfig(tmpFile, server.URL, Config{MinPollInterval: time.Millisecond})
+	require.NoError(t, err)
+	progress = d.ProgressChan()
+	require.NoError(t, d.Run())
+	var last int64
+	for completed := range progress {
+		last = completed
+	}
+	require.Equal(t, int64(20000), last)
+}
+
+func TestProgressOutput(t *testing.T) {
+	server := newSlowServer(t, 20, 50*time.Millisecond)
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	out := &syncBuffer{}
+	config := Config{
+		ProgressOutput:  out,
+		MinPollInterval: 100 * time.Millisecond,
+	}
+	d, err := DownloadWithConfig(tmpFile, server.URL, config)
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+
+	output := out.String()
+	require.True(t, strings.HasSuffix(output, "\r"))
+	lines := strings.Split(strings.TrimPrefix(output, "\r"), "\r")
+	require.True(t, len(lines) > 3)
+	blank := lines[len(lines)-2]
+	require.Equal(t, "", strings.TrimSpace(blank))
+	re := regexp.MustCompile(`^(\d+)% \d+(\.\d)? [kMG]?B/s( ETA \w+)?$`)
+	prev := -1
+	for _, line := range lines[:len(lines)-2] {
+		m := re.FindStringSubmatch(strings.TrimSpace(line))
+		require.NotNil(t, m, "invalid status line %q", line)
+		var percent int
+		fmt.Sscan(m[1], &percent)
+		require.True(t, percent >= prev)
+		prev = percent
+	}
+	require.True(t, prev > 0)
+}
+
+func TestDownloadToBuffer(t *testing.T) {
+	server := newTestFileServer(t)
+
+	var buf bytes.Buffer
+	d, err := DownloadToWriter(&buf, server.URL+"/test.txt", Config{ExpectedChecksum: testFileSHA256})
+	require.NoError(t, err)
+	var last int64
+	require.NoError(t, d.RunAndPoll(func(current int64) { last = current }, 10*time.Millisecond))
+	require.Equal(t, int64(8052), last)
+	require.Equal(t, "", d.Path())
+
+	data, err := os.ReadFile("testdata/test.txt")
+	require.NoError(t, err)
+	require.Equal(t, data, buf.Bytes())
+}
+
+func TestFormatBytes(t *testing.T) {
+	require.Equal(t, "999 B", formatBytes(999))
+	require.Equal(t, "2.3 MB", formatBytes(2300000))
+	require.Equal(t, "1.0 kB", formatBytes(1000))
+}
+
+func TestDownloadToWriter(t *testing.T) {
+	server := newTestFileServer(t)
+
+	// Simulate a pipe, like "download URL | tar xz"
+	r, w := io.Pipe()
+	d, err := DownloadToWriter(w, server.URL+"/test.txt", Config{})
+	require.NoError(t, err)
+	require.Equal(t, int64(8052), d.Size())
+	go func() {
+		_ = w.CloseWithError(d.Run())
+	}()
+	received, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, int64(8052), d.Completed())
+
+	data, err := os.ReadFile("testdata/test.txt")
+	require.NoError(t, err)
+	require.Equal(t, data, received)
+}
+
+func TestDownloadToStdoutMovesProgressToStderr(t *testing.T) {
+	server := newTestFileServer(t)
+
+	d, err := DownloadToWriter(os.Stdout, server.URL+"/test.txt", Config{ProgressOutput: os.Stdout})
+	require.NoError(t, err)
+	require.Equal(t, os.Stderr, d.config.ProgressOutput)
+	require.NoError(t, d.Close())
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	server := newTestFileServer(t)
+	dir, err := os.MkdirTemp("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	url := server.URL + "/test.txt"
+	d, err := DownloadWithConfig(tmpFile, url, Config{Transport: NewRecorder(dir, RecordMode)})
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	requireSameAsTestFile(t, tmpFile)
+	server.Close()
+
+	// Download again with the server stopped
+	require.NoError(t, os.Remove(tmpFile))
+	d, err = DownloadWithConfig(tmpFile, url, Config{Transport: NewRecorder(dir, ReplayMode)})
+	require.NoError(t, err)
+	require.Equal(t, int64(8052), d.Size())
+	require.NoError(t, d.Run())
+	requireSameAsTestFile(t, tmpFile)
+
+	_, err = DownloadWithConfig(tmpFile, server.URL+"/missing", Config{Transport: NewRecorder(dir, ReplayMode)})
+	require.Error(t, err)
+	fmt.Println("ERROR:", err)
+}
+
+func TestCacheKeyHeader(t *testing.T) {
+	var cacheKey string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cacheKey = r.Header.Get("X-Cache-Key")
+		fmt.Fprint(w, "Hello")
+	}))
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	d, err := DownloadWithConfig(tmpFile, server.URL, Config{CacheKey: "artifact-1.2.3"})
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	require.Equal(t, "artifact-1.2.3", cacheKey)
+}
+
+func TestTraceID(t *testing.T) {
+	var lock sync.Mutex
+	traceIDs := map[string][]string{}
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		traceIDs[r.URL.Path] = append(traceIDs[r.URL.Path], r.Header.Get("X-Trace"))
+		lock.Unlock()
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "/file", http.StatusFound)
+			return
+		}
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "Hello")
+	}))
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	config := Config{TraceID: "trace-1", TraceHeader: "X-Trace", MaxRetries: 1, RetryDelay: time.Millisecond}
+	d, err := DownloadWithConfig(tmpFile, server.URL+"/redirect", config)
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	require.Equal(t, map[string][]string{
+		"/redirect": {"trace-1", "trace-1"},
+		"/file":     {"trace-1", "trace-1"},
+	}, traceIDs)
+
+	var requestID string
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID = r.Header.Get("X-Request-ID")
+		fmt.Fprint(w, "Hello")
+	}))
+	defer server.Close()
+	d, err = DownloadWithConfig(tmpFile, server.URL, Config{TraceID: "trace-2"})
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	require.Equal(t, "trace-2", requestID)
+}
+
+func TestUseHEAD(t *testing.T) {
+	data, err := os.ReadFile("testdata/test.txt")
+	require.NoError(t, err)
+	var lock sync.Mutex
+	methods := []string{}
+	supportsHEAD := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		methods = append(methods, r.Method)
+		head := supportsHEAD
+		lock.Unlock()
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == "HEAD" {
+			if !head {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			return
+		}
+		// The size is not sent in the response to the GET request
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write(data[:1000])
+		w.(http.Flusher).Flush()
+		_, _ = w.Write(data[1000:])
+	}))
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	d, err := DownloadWithConfig(tmpFile, server.URL, Config{})
+	require.NoError(t, err)
+	require.Equal(t, int64(-1), d.Size())
+	require.NoError(t, d.Run())
+
+	methods = []string{}
+	d, err = DownloadWithConfig(tmpFile, server.URL, Config{UseHEAD: true})
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), d.Size())
+	require.NoError(t, d.Run())
+	requireSameAsTestFile(t, tmpFile)
+	require.Equal(t, []string{"HEAD", "GET"}, methods)
+
+	// The HEAD response is checked with AcceptFunc, and a rejected download
+	// is stopped before the GET request
+	methods = []string{}
+	rejected := errors.New("rejected")
+	accepted := []string{}
+	accept := func(resp *http.Response) error {
+		accepted = append(accepted, resp.Request.Method)
+		if resp.Request.Method == "HEAD" {
+			return rejected
+		}
+		return nil
+	}
+	_, err = DownloadWithConfig(tmpFile, server.URL, Config{UseHEAD: true, AcceptFunc: accept})
+	require.True(t, errors.Is(err, rejected))
+	require.Equal(t, []string{"HEAD"}, methods)
+	require.Equal(t, []string{"HEAD"}, accepted)
+
+	// An error status of the HEAD request stops the download before the GET
+	methods = []string{}
+	_, err = DownloadWithConfig(tmpFile, server.URL+"/missing", Config{UseHEAD: true})
+	require.Error(t, err)
+	fmt.Println("ERROR:", err)
+	require.Equal(t, &HTTPStatusError{Code: 404, Status: "404 Not Found"}, err)
+	require.Equal(t, []string{"HEAD"}, methods)
+
+	// Servers that don't support HEAD requests fall back to the GET request
+	methods, accepted = []string{}, []string{}
+	lock.Lock()
+	supportsHEAD = false
+	lock.Unlock()
+	d, err = DownloadWithConfig(tmpFile, server.URL, Config{UseHEAD: true, AcceptFunc: accept})
+	require.NoError(t, err)
+	require.Equal(t, int64(-1), d.Size())
+	require.NoError(t, d.Run())
+	requireSameAsTestFile(t, tmpFile)
+	require.Equal(t, []string{"HEAD", "GET"}, methods)
+	require.Equal(t, []string{"GET"}, accepted)
+}
+
+func TestOpenRange(t *testing.T) {
+	server := newTestFileServer(t)
+	data, err := os.ReadFile("testdata/test.txt")
+	require.NoError(t, err)
+
+	r, size, err := OpenRange(context.Background(), server.URL+"/test.txt", 100, 199, Config{})
+	require.NoError(t, err)
+	require.Equal(t, int64(8052), size)
+	content, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	require.Equal(t, data[100:200], content)
+
+	noRanges := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(data)
+	}))
+	defer noRanges.Close()
+	_, _, err = OpenRange(context.Background(), noRanges.URL, 100, 199, Config{})
+	require.Error(t, err)
+	fmt.Println("ERROR:", err)
+	require.True(t, errors.Is(err, ErrRangeNotSupported))
+	require.Contains(t, err.Error(), "server doesn't support range requests")
+
+	_, _, err = OpenRange(context.Background(), server.URL+"/notfound.txt", 100, 199, Config{})
+	fmt.Println("ERROR:", err)
+	var statusErr *HTTPStatusError
+	require.True(t, errors.As(err, &statusErr))
+	require.Equal(t, http.StatusNotFound, statusErr.Code)
+}
+
+const testFileSHA256 = "sha256:b5be5de37286de89df5650cc30ca6a76fbc034a7ec50eb9371ca196b56425efb"
+
+func TestExpectedChecksumFunc(t *testing.T) {
+	server := newTestFileServer(t)
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	// The expected checksum is provided after the download started
+	checksum := make(chan string)
+	config := Config{
+		ExpectedChecksumFunc: func() (string, error) {
+			return <-checksum, nil
+		},
+	}
+	d, err := DownloadWithConfig(tmpFile, server.URL+"/test.txt", config)
+	require.NoError(t, err)
+	res := make(chan error)
+	go func() { res <- d.Run() }()
+	time.Sleep(100 * time.Millisecond)
+	checksum <- testFileSHA256
+	require.NoError(t, <-res)
+
+	// Resumed download with wrong checksum
+	part, err := os.ReadFile("testdata/test.txt.part")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(tmpFile, part, 0644))
+	d, err = DownloadWithConfig(tmpFile, server.URL+"/test.txt", config)
+	require.NoError(t, err)
+	require.Equal(t, int64(3506), d.Completed())
+	go func() { checksum <- "sha256:0000" }()
+	err = d.Run()
+	require.Error(t, err)
+	require.Equal(t, &ChecksumMismatchError{Expected: "sha256:0000", Got: testFileSHA256}, err)
+}
+
+func TestBackupExisting(t *testing.T) {
+	server := newTestFileServer(t)
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+	defer os.Remove(tmpFile + ".bak")
+
+	part, err := os.ReadFile("testdata/test.txt.part")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(tmpFile, part, 0644))
+
+	d, err := DownloadWithConfig(tmpFile, server.URL+"/test.txt", Config{BackupExisting: true}, NoResume)
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	requireSameAsTestFile(t, tmpFile)
+
+	backup, err := os.ReadFile(tmpFile + ".bak")
+	require.NoError(t, err)
+	require.Equal(t, part, backup)
+}
+
+func TestProgressConsistency(t *testing.T) {
+	server := newSlowServer(t, 20, 5*time.Millisecond)
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	d, err := Download(tmpFile, server.URL)
+	require.NoError(t, err)
+	res := make(chan error)
+	go func() { res <- d.Run() }()
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			prev := int64(0)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				completed, total := d.Progress()
+				if completed < prev || completed > total || total != 20000 {
+					t.Errorf("inconsistent progress %d/%d", completed, total)
+					return
+				}
+				prev = completed
+			}
+		}()
+	}
+	require.NoError(t, <-res)
+	close(stop)
+	wg.Wait()
+	completed, total := d.Progress()
+	require.Equal(t, int64(20000), completed)
+	require.Equal(t, int64(20000), total)
+}
+
+func TestExpectedChecksum(t *testing.T) {
+	server := newTestFileServer(t)
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	// Matching checksum
+	d, err := DownloadWithConfig(tmpFile, server.URL+"/test.txt", Config{ExpectedChecksum: testFileSHA256})
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	requireSameAsTestFile(t, tmpFile)
+
+	// Mismatching checksum
+	config := Config{ExpectedChecksum: "md5:00000000000000000000000000000000"}
+	d, err = DownloadWithConfig(tmpFile, server.URL+"/test.txt", config, NoResume)
+	require.NoError(t, err)
+	err = d.Run()
+	fmt.Println("ERROR:", err)
+	require.Equal(t, &ChecksumMismatchError{
+		Expected: "md5:00000000000000000000000000000000",
+		Got:      "md5:808c0d92bb68fb4f332f1c4258f52fef",
+	}, err)
+
+	// Resumed download: the partial file must be hashed too
+	part, err := os.ReadFile("testdata/test.txt.part")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(tmpFile, part, 0644))
+	config = Config{ExpectedChecksum: "md5:808c0d92bb68fb4f332f1c4258f52fef"}
+	d, err = DownloadWithConfig(tmpFile, server.URL+"/test.txt", config)
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	require.True(t, d.resumed)
+	requireSameAsTestFile(t, tmpFile)
+}
+
+func TestCRC32Checksum(t *testing.T) {
+	server := newTestFileServer(t)
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	config := Config{
+		ExpectedChecksum: "crc32:0b4fa4cb",
+		ComputeDigests:   []string{"crc32c"},
+	}
+	d, err := DownloadWithConfig(tmpFile, server.URL+"/test.txt", config)
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	digests := d.Digests()
+	require.Len(t, digests, 2)
+	require.Equal(t, "0b4fa4cb", digests["crc32"])
+	require.Len(t, digests["crc32c"], 8)
+
+	config.ExpectedChecksum = "CRC32:0B4FA4CC"
+	d, err = DownloadWithConfig(tmpFile, server.URL+"/test.txt", config, NoResume)
+	require.NoError(t, err)
+	require.Equal(t, &ChecksumMismatchError{Expected: "CRC32:0B4FA4CC", Got: "crc32:0b4fa4cb"}, d.Run())
+}
+
+func TestRunWithTimeout(t *testing.T) {
+	server := newSlowServer(t, 20, 50*time.Millisecond)
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	d, err := Download(tmpFile, server.URL)
+	require.NoError(t, err)
+	err = d.RunWithTimeout(300 * time.Millisecond)
+	require.Error(t, err)
+	require.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+	fmt.Println("ERROR:", err)
+	require.True(t, d.Completed() < d.Size())
+
+	// Partial file is kept, and a download that completes in time succeeds
+	info, err := os.Stat(tmpFile)
+	require.NoError(t, err)
+	require.True(t, info.Size() > 0)
+	d, err = Download(tmpFile, server.URL)
+	require.NoError(t, err)
+	require.NoError(t, d.RunWithTimeout(10*time.Second))
+}
+
+func TestProgressReporter(t *testing.T) {
+	server := newSlowServer(t, 20, 20*time.Millisecond)
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	var snapshots []ProgressSnapshot
+	logs := &syncBuffer{}
+	config := Config{
+		MinPollInterval: 50 * time.Millisecond,
+		Logger:          slog.New(slog.NewTextHandler(logs, nil)),
+		ProgressReporter: func(ctx context.Context, snapshot ProgressSnapshot) error {
+			snapshots = append(snapshots, snapshot)
+			return errors.New("collector unavailable")
+		},
+	}
+	d, err := DownloadWithConfig(tmpFile, server.URL, config)
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+
+	require.True(t, len(snapshots) > 3)
+	for i, snapshot := range snapshots {
+		require.Equal(t, server.URL, snapshot.URL)
+		require.Equal(t, tmpFile, snapshot.Path)
+		require.Equal(t, int64(20000), snapshot.Total)
+		if i > 0 {
+			require.True(t, snapshot.Completed >= snapshots[i-1].Completed)
+		}
+	}
+	require.Equal(t, int64(20000), snapshots[len(snapshots)-1].Completed)
+	require.Contains(t, logs.String(), "collector unavailable")
+}
+
+func TestMinTLSVersion(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "Hello")
+	}))
+	server.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	server.StartTLS()
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	d, err := DownloadWithConfig(tmpFile, server.URL, Config{MinTLSVersion: tls.VersionTLS13})
+	require.Error(t, err)
+	require.Nil(t, d)
+	require.Contains(t, err.Error(), "protocol version")
+	fmt.Println("ERROR:", err)
+}
+
+func TestSRI(t *testing.T) {
+	server := newTestFileServer(t)
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	data, err := os.ReadFile("testdata/test.txt")
+	require.NoError(t, err)
+	sum := sha512.Sum384(data)
+	good := "sha384-" + base64.StdEncoding.EncodeToString(sum[:])
+	bad := "sha256-47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="
+
+	d, err := DownloadWithConfig(tmpFile, server.URL+"/test.txt", Config{SRI: bad + " md5-ignored " + good})
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+
+	d, err = DownloadWithConfig(tmpFile, server.URL+"/test.txt", Config{SRI: bad}, NoResume)
+	require.NoError(t, err)
+	err = d.Run()
+	var mismatch *ChecksumMismatchError
+	require.True(t, errors.As(err, &mismatch))
+	require.Equal(t, bad, mismatch.Expected)
+}
+
+func TestRunAndPollWithStateOnCancel(t *testing.T) {
+	server := newSlowServer(t, 20, 50*time.Millisecond)
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d, err := DownloadWithConfigAndContext(ctx, tmpFile, server.URL, Config{})
+	require.NoError(t, err)
+	time.AfterFunc(200*time.Millisecond, cancel)
+
+	states := []State{}
+	err = d.RunAndPollWithState(func(current int64, state State) {
+		states = append(states, state)
+	}, 50*time.Millisecond)
+	require.True(t, errors.Is(err, context.Canceled))
+	require.True(t, len(states) > 1)
+	require.Equal(t, Canceled, states[len(states)-1])
+	for _, state := range states[:len(states)-1] {
+		require.Equal(t, Running, state)
+	}
+}
+
+func TestRunAndPollWithStateOnCompletion(t *testing.T) {
+	server := newTestFileServer(t)
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	d, err := Download(tmpFile, server.URL+"/test.txt")
+	require.NoError(t, err)
+	var final State
+	require.NoError(t, d.RunAndPollWithState(func(current int64, state State) {
+		final = state
+	}, time.Second))
+	require.Equal(t, Completed, final)
+	require.Equal(t, "completed", final.String())
+}
+
+// corruptingFile is an output file that returns corrupted data when read back
+type corruptingFile struct {
+	*os.File
+}
+
+func (f corruptingFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(p, off)
+	if n > 0 {
+		p[0] ^= 0xFF
+	}
+	return n, err
+}
+
+func TestVerifyWrites(t *testing.T) {
+	server := newTestFileServer(t)
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	d, err := DownloadWithConfig(tmpFile, server.URL+"/test.txt", Config{VerifyWrites: true})
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	requireSameAsTestFile(t, tmpFile)
+
+	d, err = DownloadWithConfig(tmpFile, server.URL+"/test.txt", Config{VerifyWrites: true}, NoResume)
+	require.NoError(t, err)
+	d.out = corruptingFile{d.out.(*os.File)}
+	err = d.Run()
+	require.True(t, errors.Is(err, ErrWriteVerificationFailed))
+	fmt.Println("ERROR:", err)
+}
+
+func TestVerifyServerChecksumInTrailer(t *testing.T) {
+	data, err := os.ReadFile("testdata/test.txt")
+	require.NoError(t, err)
+	sum := sha256.Sum256(data)
+	digest := base64.StdEncoding.EncodeToString(sum[:])
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Digest")
+		_, _ = w.Write(data)
+		if r.URL.Path == "/bad" {
+			w.Header().Set("Digest", "sha-256=47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=")
+		} else {
+			w.Header().Set("Digest", "sha-256="+digest)
+		}
+	}))
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	d, err := DownloadWithConfig(tmpFile, server.URL+"/good", Config{VerifyServerChecksum: true})
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	requireSameAsTestFile(t, tmpFile)
+
+	d, err = DownloadWithConfig(tmpFile, server.URL+"/bad", Config{VerifyServerChecksum: true}, NoResume)
+	require.NoError(t, err)
+	err = d.Run()
+	var mismatch *ChecksumMismatchError
+	require.True(t, errors.As(err, &mismatch))
+	require.Equal(t, "sha-256="+digest, mismatch.Got)
+}
+
+func TestVerifyServerChecksumOnResume(t *testing.T) {
+	data, err := os.ReadFile("testdata/test.txt")
+	require.NoError(t, err)
+	digestOf := func(data []byte) string {
+		sum := sha256.Sum256(data)
+		return "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := data
+		var start int
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start); err == nil {
+			body = data[start:]
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(data)-1, len(data)))
+		}
+		// The Content-Digest covers only the range sent
+		w.Header().Set("Content-Digest", digestOf(body))
+		if r.URL.Path == "/bad" {
+			w.Header().Set("Repr-Digest", digestOf(nil))
+		} else {
+			w.Header().Set("Repr-Digest", digestOf(data))
+		}
+		if len(body) < len(data) {
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		_, _ = w.Write(body)
+	}))
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+	part, err := os.ReadFile("testdata/test.txt.part")
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(tmpFile, part, 0644))
+	d, err := DownloadWithConfig(tmpFile, server.URL+"/good", Config{VerifyServerChecksum: true})
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	require.True(t, d.resumed)
+	requireSameAsTestFile(t, tmpFile)
+
+	require.NoError(t, os.WriteFile(tmpFile, part, 0644))
+	d, err = DownloadWithConfig(tmpFile, server.URL+"/bad", Config{VerifyServerChecksum: true})
+	require.NoError(t, err)
+	require.True(t, d.resumed)
+	err = d.Run()
+	var mismatch *ChecksumMismatchError
+	require.True(t, errors.As(err, &mismatch))
+	require.Equal(t, digestOf(nil), mismatch.Expected)
+}
+
+func gzipData(t *testing.T, data []byte) []byte {
+	var buff bytes.Buffer
+	zw := gzip.NewWriter(&buff)
+	_, err := zw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return buff.Bytes()
+}
+
+func TestSmartDecompress(t *testing.T) {
+	data, err := os.ReadFile("testdata/test.txt")
+	require.NoError(t, err)
+	gzipped := gzipData(t, data)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		switch r.URL.Path {
+		case "/test.txt.gz":
+			// Misconfigured server: the .gz file is sent as is
+			_, _ = w.Write(gzipped)
+		case "/double.txt.gz":
+			_, _ = w.Write(gzipData(t, gzipped))
+		case "/test.txt":
+			_, _ = w.Write(gzipped)
+		}
+	}))
+	defer server.Close()
+	dir, err := os.MkdirTemp("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	logs := &syncBuffer{}
+	config := Config{
+		SmartDecompress: true,
+		Logger:          slog.New(slog.NewTextHandler(logs, nil)),
+	}
+	download := func(config Config, name string) []byte {
+		file := filepath.Join(dir, name)
+		d, err := DownloadWithConfig(file, server.URL+"/"+name, config, NoResume)
+		require.NoError(t, err)
+		require.NoError(t, d.Run())
+		res, err := os.ReadFile(file)
+		require.NoError(t, err)
+		return res
+	}
+
+	// Without SmartDecompress the .gz file is decompressed
+	require.Equal(t, data, download(Config{}, "test.txt.gz"))
+
+	require.Equal(t, gzipped, download(config, "test.txt.gz"))
+	require.Contains(t, logs.String(), "keeping the content as is")
+	require.Equal(t, gzipped, download(config, "double.txt.gz"))
+	require.Contains(t, logs.String(), "decompressing only once")
+	require.Equal(t, data, download(config, "test.txt"))
+}
+
+func TestOffsetHeader(t *testing.T) {
+	data, err := os.ReadFile("testdata/test.txt")
+	require.NoError(t, err)
+	var requestedRange string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			w.Header().Set("Upload-Offset", "1000")
+			return
+		}
+		requestedRange = r.Header.Get("Range")
+		http.ServeContent(w, r, "test.txt", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	part, err := os.ReadFile("testdata/test.txt.part")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(tmpFile, part, 0644))
+
+	d, err := DownloadWithConfig(tmpFile, server.URL, Config{OffsetHeader: "Upload-Offset"})
+	require.NoError(t, err)
+	require.Equal(t, "bytes=1000-", requestedRange)
+	require.Equal(t, int64(1000), d.Completed())
+	require.NoError(t, d.Run())
+	requireSameAsTestFile(t, tmpFile)
+}
+
+func TestMaxDecompressedSize(t *testing.T) {
+	bomb := gzipData(t, make([]byte, 10*1024*1024))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		_, _ = w.Write(bomb)
+	}))
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	for _, smart := range []bool{false, true} {
+		config := Config{MaxDecompressedSize: 1024 * 1024, SmartDecompress: smart}
+		d, err := DownloadWithConfig(tmpFile, server.URL, config, NoResume)
+		require.NoError(t, err)
+		require.Equal(t, ErrDecompressionLimitExceeded, d.Run())
+		require.Equal(t, int64(1024*1024), d.Completed())
+	}
+
+	d, err := DownloadWithConfig(tmpFile, server.URL, Config{MaxDecompressedSize: 20 * 1024 * 1024}, NoResume)
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	require.Equal(t, int64(10*1024*1024), d.Completed())
+}
+
+func TestVerifyOnlyFreshDownloads(t *testing.T) {
+	server := newTestFileServer(t)
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	config := Config{
+		ExpectedChecksum:         "sha256:0000",
+		VerifyOnlyFreshDownloads: true,
+	}
+
+	// Resumed download: the checksum is not verified
+	part, err := os.ReadFile("testdata/test.txt.part")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(tmpFile, part, 0644))
+	d, err := DownloadWithConfig(tmpFile, server.URL+"/test.txt", config)
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	requireSameAsTestFile(t, tmpFile)
+
+	// Fresh download: the checksum is verified
+	d, err = DownloadWithConfig(tmpFile, server.URL+"/test.txt", config, NoResume)
+	require.NoError(t, err)
+	var mismatch *ChecksumMismatchError
+	require.True(t, errors.As(d.Run(), &mismatch))
+}
+
+// failingWriter fails after writing limit bytes
+type failingWriter struct {
+	limit int
+	err   error
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		n := w.limit
+		w.limit = 0
+		return n, w.err
+	}
+	w.limit -= len(p)
+	return len(p), nil
+}
+
+func TestWriteErrors(t *testing.T) {
+	server := newTestFileServer(t)
+	diskFull := errors.New("no space left on device")
+	for _, writeErr := range []error{diskFull, nil} {
+		w := &failingWriter{limit: 5000, err: writeErr}
+		d, err := DownloadToWriter(w, server.URL+"/test.txt", Config{})
+		require.NoError(t, err)
+		err = d.Run()
+		require.Error(t, err)
+		fmt.Println("ERROR:", err)
+		if writeErr != nil {
+			require.True(t, errors.Is(err, diskFull))
+		} else {
+			require.True(t, errors.Is(err, io.ErrShortWrite))
+		}
+		require.Equal(t, int64(5000), d.Completed())
+	}
+}
+
+func TestResumeWithServerIgnoringRange(t *testing.T) {
+	data, err := os.ReadFile("testdata/test.txt")
+	require.NoError(t, err)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Always send the whole file with 200 OK
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		_, _ = w.Write(data)
+	}))
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	part, err := os.ReadFile("testdata/test.txt.part")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(tmpFile, part, 0644))
+
+	d, err := Download(tmpFile, server.URL)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), d.Completed())
+	require.Equal(t, int64(8052), d.Size())
+	require.NoError(t, d.Run())
+	require.Equal(t, int64(8052), d.Completed())
+	requireSameAsTestFile(t, tmpFile)
+}
+
+func TestDownloadToDir(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if disposition := r.URL.Query().Get("disposition"); disposition != "" {
+			w.Header().Set("Content-Disposition", disposition)
+		}
+		http.ServeFile(w, r, "testdata/test.txt")
+	}))
+	defer server.Close()
+	dir, err := os.MkdirTemp("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		disposition string
+		name        string
+	}{
+		{"", "file.bin"},
+		{`attachment; filename="report.txt"`, "report.txt"},
+		{`attachment; filename*=UTF-8''r%C3%A9sum%C3%A9.txt`, "résumé.txt"},
+		{`attachment; filename="../../etc/passwd"`, "passwd"},
+		{`attachment; filename="..\\..\\evil.txt"`, "evil.txt"},
+		{`attachment; filename=".."`, "download"},
+	}
+	for _, test := range tests {
+		d, err := DownloadToDir(dir, server.URL+"/path/file.bin?disposition="+url.QueryEscape(test.disposition), Config{})
+		require.NoError(t, err)
+		require.NoError(t, d.Run())
+		require.Equal(t, test.name, d.FileName(), test.disposition)
+		require.Equal(t, filepath.Join(dir, test.name), d.Path())
+		requireSameAsTestFile(t, d.Path())
+	}
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, len(tests))
+}
+
+func TestDownloadToDirInferExtension(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		fmt.Fprint(w, `{"hello":"world"}`)
+	}))
+	defer server.Close()
+	dir, err := os.MkdirTemp("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	d, err := DownloadToDir(dir, server.URL+"/api/data", Config{})
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	require.Equal(t, filepath.Join(dir, "data"), d.Path())
+
+	d, err = DownloadToDir(dir, server.URL+"/api/data", Config{InferExtension: true})
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	require.Equal(t, filepath.Join(dir, "data.json"), d.Path())
+	content, err := os.ReadFile(d.Path())
+	require.NoError(t, err)
+	require.Equal(t, `{"hello":"world"}`, string(content))
+
+	d, err = DownloadToDir(dir, server.URL+"/archive.tar", Config{InferExtension: true})
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	require.Equal(t, filepath.Join(dir, "archive.tar"), d.Path())
+}
+
+func TestCommitOnlyAfterVerification(t *testing.T) {
+	server := newTestFileServer(t)
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+	defer os.Remove(tmpFile + ".download")
+	require.NoError(t, os.WriteFile(tmpFile, []byte("previous content"), 0644))
+
+	config := Config{
+		CommitOnlyAfterVerification: true,
+		ExpectedChecksum:            "sha256:0000000000000000000000000000000000000000000000000000000000000000",
+	}
+	d, err := DownloadWithConfig(tmpFile, server.URL+"/test.txt", config)
+	require.NoError(t, err)
+	err = d.Run()
+	fmt.Println("ERROR:", err)
+	var mismatch *ChecksumMismatchError
+	require.True(t, errors.As(err, &mismatch))
+	content, err := os.ReadFile(tmpFile)
+	require.NoError(t, err)
+	require.Equal(t, "previous content", string(content))
+	_, err = os.Stat(tmpFile + ".download")
+	require.True(t, os.IsNotExist(err))
+
+	config.ExpectedChecksum = testFileSHA256
+	d, err = DownloadWithConfig(tmpFile, server.URL+"/test.txt", config)
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	require.Equal(t, tmpFile, d.Path())
+	requireSameAsTestFile(t, tmpFile)
+	_, err = os.Stat(tmpFile + ".download")
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestAsyncRunDoesNotLeakOnCancel(t *testing.T) {
+	server := newSlowServer(t, 100, 20*time.Millisecond)
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	baseline := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	d, err := DownloadWithConfigAndContext(ctx, tmpFile, server.URL, Config{}, NoResume)
+	require.NoError(t, err)
+	go d.AsyncRun()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	// Nobody reads from d.Done: the download goroutine must terminate anyway
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > baseline && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	require.True(t, runtime.NumGoroutine() <= baseline, "download goroutine leaked")
+	<-d.Done
+	require.Error(t, d.Error())
+}
+
+func TestCancel(t *testing.T) {
+	server := newSlowServer(t, 100, 20*time.Millisecond)
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	d, err := Download(tmpFile, server.URL)
+	require.NoError(t, err)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		d.Cancel()
+	}()
+	err = d.RunAndPoll(func(current int64) {}, 10*time.Millisecond)
+	fmt.Println("ERROR:", err)
+	require.True(t, errors.Is(err, context.Canceled))
+	require.Equal(t, Canceled, stateFromError(err))
+	require.True(t, d.Completed() > 0)
+	require.True(t, d.Completed() < d.Size())
+
+	info, err := os.Stat(tmpFile)
+	require.NoError(t, err)
+	require.Equal(t, d.Completed(), info.Size())
+}
+
+func TestRangeHeaderFunc(t *testing.T) {
+	data, err := os.ReadFile("testdata/test.txt")
+	require.NoError(t, err)
+	var rangeHeader, customHeader string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rangeHeader = r.Header.Get("Range")
+		customHeader = r.Header.Get("X-Resume-From")
+		var offset int
+		fmt.Sscanf(customHeader, "offset=%d", &offset)
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, len(data)-1, len(data)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(data[offset:])
+	}))
+	defer server.Close()
+
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+	part, err := os.ReadFile("testdata/test.txt.part")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(tmpFile, part, 0644))
+
+	config := Config{
+		RangeHeaderFunc: func(offset int64) (string, string) {
+			return "X-Resume-From", fmt.Sprintf("offset=%d", offset)
+		},
+	}
+	d, err := DownloadWithConfig(tmpFile, server.URL, config)
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	require.Equal(t, "", rangeHeader)
+	require.Equal(t, fmt.Sprintf("offset=%d", len(part)), customHeader)
+	requireSameAsTestFile(t, tmpFile)
+}
+
+type slowWriter struct {
+	delay time.Duration
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(w.delay)
+	return len(p), nil
+}
+
+func TestDownloadedAndWritten(t *testing.T) {
+	server := newSlowServer(t, 20, 5*time.Millisecond)
+
+	d, err := DownloadToWriter(&slowWriter{delay: 10 * time.Millisecond}, server.URL, Config{})
+	require.NoError(t, err)
+	res := make(chan error)
+	go func() { res <- d.Run() }()
+
+	sawLag := false
+	for {
+		select {
+		case err := <-res:
+			require.NoError(t, err)
+			require.Equal(t, int64(20000), d.Downloaded())
+			require.Equal(t, int64(20000), d.Written())
+			require.True(t, sawLag)
+			return
+		default:
+		}
+		written := d.Written()
+		downloaded := d.Downloaded()
+		require.True(t, downloaded >= written, "downloaded %d < written %d", downloaded, written)
+		if downloaded > written {
+			sawLag = true
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDownloadParallel(t *testing.T) {
+	data, err := os.ReadFile("testdata/test.txt")
+	require.NoError(t, err)
+	var rangesLock sync.Mutex
+	ranges := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			rangesLock.Lock()
+			ranges = append(ranges, r.Header.Get("Range"))
+			rangesLock.Unlock()
+		}
+		http.ServeContent(w, r, "test.txt", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	config := Config{ExpectedChecksum: testFileSHA256}
+	d, err := DownloadParallel(tmpFile, server.URL, 4, config)
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	requireSameAsTestFile(t, tmpFile)
+	require.Equal(t, int64(len(data)), d.Completed())
+	require.Equal(t, int64(len(data)), d.Size())
+	require.ElementsMatch(t, []string{"bytes=0-2012", "bytes=2013-4025", "bytes=4026-6038", "bytes=6039-8051"}, ranges)
+
+	// Less than one connection means a single stream
+	for _, connections := range []int{0, -1} {
+		rangesLock.Lock()
+		ranges = []string{}
+		rangesLock.Unlock()
+		d, err = DownloadParallel(tmpFile, server.URL, connections, config)
+		require.NoError(t, err)
+		require.NoError(t, d.Run())
+		requireSameAsTestFile(t, tmpFile)
+		require.Equal(t, []string{""}, ranges)
+	}
+}
+
+func TestDownloadParallelSegmentRetry(t *testing.T) {
+	data, err := os.ReadFile("testdata/test.txt")
+	require.NoError(t, err)
+	var lock sync.Mutex
+	ranges := []string{}
+	failures := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.ServeContent(w, r, "test.txt", time.Time{}, bytes.NewReader(data))
+			return
+		}
+		lock.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		failing := strings.HasPrefix(r.Header.Get("Range"), "bytes=4") && failures < 2
+		if failing {
+			failures++
+		}
+		failure := failures
+		lock.Unlock()
+		if failing && failure == 1 {
+			// The connection is dropped in the middle of the segment
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 4026-6038/%d", len(data)))
+			w.Header().Set("Content-Length", "2013")
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write(data[4026:4526])
+			return
+		}
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		http.ServeContent(w, r, "test.txt", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	config := Config{ExpectedChecksum: testFileSHA256, MaxRetries: 2, RetryDelay: time.Millisecond}
+	d, err := DownloadParallel(tmpFile, server.URL, 4, config)
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	requireSameAsTestFile(t, tmpFile)
+	require.ElementsMatch(t, []string{
+		"bytes=0-2012", "bytes=2013-4025", "bytes=4026-6038", "bytes=6039-8051",
+		// The failing segment is retried from the last byte written
+		"bytes=4526-6038", "bytes=4526-6038",
+	}, ranges)
+
+	// The download fails once the retries are exhausted
+	lock.Lock()
+	ranges, failures = []string{}, 0
+	lock.Unlock()
+	require.NoError(t, os.Remove(tmpFile))
+	config.MaxRetries = 1
+	d, err = DownloadParallel(tmpFile, server.URL, 4, config)
+	require.NoError(t, err)
+	err = d.Run()
+	require.Error(t, err)
+	fmt.Println("ERROR:", err)
+	require.Equal(t, &HTTPStatusError{Code: 503, Status: "503 Service Unavailable"}, errors.Unwrap(err))
+	_ = os.Remove(segmentsMetaPath(tmpFile))
+}
+
+// syncCountingFile counts the calls to Sync
+type syncCountingFile struct {
+	*os.File
+	syncs *int32
+}
+
+func (f *syncCountingFile) Sync() error {
+	atomic.AddInt32(f.syncs, 1)
+	return f.File.Sync()
+}
+
+func TestDownloadParallelSavesCompletedSegments(t *testing.T) {
+	data, err := os.ReadFile("testdata/test.txt")
+	require.NoError(t, err)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") == "bytes=6039-8051" {
+			// The last segment never completes
+			<-r.Context().Done()
+			return
+		}
+		http.ServeContent(w, r, "test.txt", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+	defer os.Remove(segmentsMetaPath(tmpFile))
+
+	var syncs int32
+	config := Config{
+		OpenFunc: func(path string, resuming bool) (io.WriteCloser, error) {
+			f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+			return &syncCountingFile{File: f, syncs: &syncs}, err
+		},
+	}
+	d, err := DownloadParallel(tmpFile, server.URL, 4, config)
+	require.NoError(t, err)
+	go d.AsyncRun()
+
+	// The completed segments are saved, after flushing the output to disk,
+	// while the download is running
+	var meta *segmentsMeta
+	for i := 0; i < 200; i++ {
+		meta = loadSegmentsMeta(tmpFile)
+		if meta != nil && len(meta.Done) == 1 && meta.Done[0].End == 6038 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.NotNil(t, meta)
+	require.Equal(t, []byteRange{{Start: 0, End: 6038}}, meta.Done)
+	require.True(t, atomic.LoadInt32(&syncs) >= 3)
+	got, err := os.ReadFile(tmpFile)
+	require.NoError(t, err)
+	require.Equal(t, data[:6039], got[:6039])
+
+	d.Cancel()
+	<-d.Done
+	require.Error(t, d.Error())
+}
+
+// slowReadSeeker returns at most chunk bytes every delay
+type slowReadSeeker struct {
+	*bytes.Reader
+	chunk int
+	delay time.Duration
+}
+
+func (r *slowReadSeeker) Read(p []byte) (int, error) {
+	time.Sleep(r.delay)
+	if len(p) > r.chunk {
+		p = p[:r.chunk]
+	}
+	return r.Reader.Read(p)
+}
+
+func TestDownloadParallelAdaptiveSegments(t *testing.T) {
+	defer func(interval time.Duration) { adaptiveSegmentsInterval = interval }(adaptiveSegmentsInterval)
+	adaptiveSegmentsInterval = 50 * time.Millisecond
+
+	// Every connection is limited to about 200KB/s
+	data := bytes.Repeat([]byte("0123456789abcdef"), 8192)
+	sum := sha256.Sum256(data)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content := &slowReadSeeker{Reader: bytes.NewReader(data), chunk: 1000, delay: 5 * time.Millisecond}
+		http.ServeContent(w, r, "data.bin", time.Time{}, content)
+	}))
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	config := Config{AdaptiveSegments: true, ExpectedChecksum: fmt.Sprintf("sha256:%x", sum)}
+	d, err := DownloadParallel(tmpFile, server.URL, 4, config)
+	require.NoError(t, err)
+	require.Nil(t, d.SegmentProgress())
+	maxSegments := 0
+	err = d.RunAndPoll(func(current int64) {
+		progress := d.SegmentProgress()
+		if len(progress) > maxSegments {
+			maxSegments = len(progress)
+		}
+		for _, s := range progress {
+			require.True(t, s.Written <= s.End-s.Start+1)
+		}
+	}, 10*time.Millisecond)
+	require.NoError(t, err)
+	require.True(t, maxSegments > 1, "segments: %d", maxSegments)
+	require.True(t, maxSegments <= 4, "segments: %d", maxSegments)
+	require.Empty(t, d.SegmentProgress())
+	got, err := os.ReadFile(tmpFile)
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+}
+
+// gatedBody returns a few bytes with the first Read, then blocks the second
+// one until release is closed, returning all the rest of the body at once
+type gatedBody struct {
+	io.ReadCloser
+	reads   int
+	release chan struct{}
+}
+
+func (g *gatedBody) Read(p []byte) (int, error) {
+	g.reads++
+	switch g.reads {
+	case 1:
+		return g.ReadCloser.Read(p[:1000])
+	case 2:
+		<-g.release
+		data, err := io.ReadAll(g.ReadCloser)
+		if err != nil {
+			return 0, err
+		}
+		return copy(p, data), io.EOF
+	}
+	return 0, io.EOF
+}
+
+type gatedTransport struct {
+	release chan struct{}
+}
+
+func (g *gatedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err == nil && strings.HasPrefix(req.Header.Get("Range"), "bytes=0-") {
+		resp.Body = &gatedBody{ReadCloser: resp.Body, release: g.release}
+	}
+	return resp, err
+}
+
+func TestDownloadParallelAdaptiveSegmentsSplitDuringRead(t *testing.T) {
+	defer func(interval time.Duration) { adaptiveSegmentsInterval = interval }(adaptiveSegmentsInterval)
+	adaptiveSegmentsInterval = 10 * time.Millisecond
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 8192)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	// The first segment is split while its Read is blocked, then the Read
+	// returns more data than the segment can hold
+	release := make(chan struct{})
+	config := Config{AdaptiveSegments: true, BufferSize: 1 << 20, Transport: &gatedTransport{release: release}}
+	d, err := DownloadParallel(tmpFile, server.URL, 2, config)
+	require.NoError(t, err)
+	go d.AsyncRun()
+	for split := false; !split; time.Sleep(5 * time.Millisecond) {
+		for _, s := range d.SegmentProgress() {
+			split = split || (s.Start == 0 && s.End < int64(len(data))/2-1)
+		}
+	}
+	close(release)
+	<-d.Done
+	require.NoError(t, d.Error())
+	require.Equal(t, int64(len(data)), d.Completed())
+	got, err := os.ReadFile(tmpFile)
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+}
+
+func TestDownloadParallelWithoutRangeSupport(t *testing.T) {
+	server := newSlowServer(t, 5, 0)
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	d, err := DownloadParallel(tmpFile, server.URL, 4, Config{})
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	content, err := os.ReadFile(tmpFile)
+	require.NoError(t, err)
+	require.Equal(t, bytes.Repeat([]byte{'a'}, 5000), content)
+}
+
+func TestFetch(t *testing.T) {
+	server := newTestFileServer(t)
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	require.NoError(t, Fetch(context.Background(), tmpFile, server.URL+"/test.txt", Config{ExpectedChecksum: testFileSHA256}))
+	requireSameAsTestFile(t, tmpFile)
+
+	err := Fetch(context.Background(), tmpFile, server.URL+"/test.txt", Config{ExpectedChecksum: "crc32:00000000"}, NoResume)
+	fmt.Println("ERROR:", err)
+	var mismatch *ChecksumMismatchError
+	require.True(t, errors.As(err, &mismatch))
+}
+
+func TestCancelFlushGrace(t *testing.T) {
+	test := func(grace time.Duration) int64 {
+		release := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "3000")
+			w.Write(bytes.Repeat([]byte{'a'}, 1000))
+			w.(http.Flusher).Flush()
+			<-release
+			w.Write(bytes.Repeat([]byte{'b'}, 1000))
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		}))
+		defer server.Close()
+		tmpFile := makeTmpFile(t)
+		defer os.Remove(tmpFile)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		d, err := DownloadWithConfigAndContext(ctx, tmpFile, server.URL, Config{CancelFlushGrace: grace})
+		require.NoError(t, err)
+		res := make(chan error)
+		go func() { res <- d.Run() }()
+		for d.Completed() < 1000 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+		close(release)
+		err = <-res
+		fmt.Println("ERROR:", err)
+		require.True(t, errors.Is(err, context.Canceled))
+
+		info, err := os.Stat(tmpFile)
+		require.NoError(t, err)
+		return info.Size()
+	}
+	require.Equal(t, int64(1000), test(0))
+	require.Equal(t, int64(2000), test(500*time.Millisecond))
+}
+
+type memoryRetryStateStore struct {
+	lock   sync.Mutex
+	states map[string]RetryState
+}
+
+func (s *memoryRetryStateStore) LoadRetryState(url string) (RetryState, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.states[url], nil
+}
+
+func (s *memoryRetryStateStore) SaveRetryState(url string, state RetryState) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.states[url] = state
+	return nil
+}
+
+func TestRetry(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		http.ServeFile(w, r, "testdata/test.txt")
+	}))
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	config := Config{MaxRetries: 2, RetryDelay: 10 * time.Millisecond}
+	d, err := DownloadWithConfig(tmpFile, server.URL, config)
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	requireSameAsTestFile(t, tmpFile)
+	require.Equal(t, int32(3), atomic.LoadInt32(&requests))
+
+	// Retries exhausted
+	atomic.StoreInt32(&requests, 0)
+	config.MaxRetries = 1
+	_, err = DownloadWithConfig(tmpFile, server.URL, config, NoResume)
+	require.Equal(t, &HTTPStatusError{Code: 503, Status: "503 Service Unavailable"}, err)
+	require.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
+
+func TestRetryStateStore(t *testing.T) {
+	var requestsLock sync.Mutex
+	requests := []time.Time{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestsLock.Lock()
+		requests = append(requests, time.Now())
+		first := len(requests) == 1
+		requestsLock.Unlock()
+		if first {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		http.ServeFile(w, r, "testdata/test.txt")
+	}))
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	store := &memoryRetryStateStore{states: map[string]RetryState{}}
+	config := Config{MaxRetries: 3, RetryDelay: 500 * time.Millisecond, RetryStateStore: store}
+
+	// The first process is interrupted while waiting for the retry
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := DownloadWithConfigAndContext(ctx, tmpFile, server.URL, config)
+	fmt.Println("ERROR:", err)
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+	state, err := store.LoadRetryState(server.URL)
+	require.NoError(t, err)
+	require.Equal(t, 1, state.Attempts)
+
+	// The restarted download must wait for the persisted backoff
+	d, err := DownloadWithConfig(tmpFile, server.URL, config)
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	requireSameAsTestFile(t, tmpFile)
+	require.Len(t, requests, 2)
+	require.True(t, requests[1].Sub(requests[0]) >= 500*time.Millisecond)
+	state, err = store.LoadRetryState(server.URL)
+	require.NoError(t, err)
+	require.Equal(t, RetryState{}, state)
+}
+
+type failingRetryStateStore struct{}
+
+func (failingRetryStateStore) LoadRetryState(url string) (RetryState, error) {
+	return RetryState{}, nil
+}
+
+func (failingRetryStateStore) SaveRetryState(url string, state RetryState) error {
+	if state == (RetryState{}) {
+		return errors.New("store failure")
+	}
+	return nil
+}
+
+type failAfterRetryTransport struct {
+	requests int32
+}
+
+func (t *failAfterRetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if atomic.AddInt32(&t.requests, 1) == 1 {
+		return &http.Response{
+			Status:     "503 Service Unavailable",
+			StatusCode: http.StatusServiceUnavailable,
+			Header:     http.Header{},
+			Body:       io.NopCloser(strings.NewReader("")),
+			Request:    req,
+		}, nil
+	}
+	return nil, ErrCertPinMismatch
+}
+
+func TestRetryStateStoreFailureAfterError(t *testing.T) {
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	config := Config{
+		MaxRetries:      1,
+		RetryDelay:      time.Millisecond,
+		RetryStateStore: failingRetryStateStore{},
+		Transport:       &failAfterRetryTransport{},
+	}
+	_, err := DownloadWithConfig(tmpFile, "http://example.com/test.txt", config)
+	require.Error(t, err)
+	fmt.Println("ERROR:", err)
+	require.Contains(t, err.Error(), "store failure")
+}
+
+func TestMaxBytesPerSecond(t *testing.T) {
+	server := newSlowServer(t, 10, 0)
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	d, err := DownloadWithConfig(tmpFile, server.URL, Config{MaxBytesPerSecond: 20000})
+	require.NoError(t, err)
+	start := time.Now()
+	require.NoError(t, d.Run())
+	elapsed := time.Since(start)
+	require.Equal(t, int64(10000), d.Completed())
+	require.True(t, elapsed >= 400*time.Millisecond, "download too fast: %s", elapsed)
+	require.True(t, elapsed < 1500*time.Millisecond, "download too slow: %s", elapsed)
+}
+
+func TestMaxBytesPerSecondWithPause(t *testing.T) {
+	server := newSlowServer(t, 10, 0)
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	d, err := DownloadWithConfig(tmpFile, server.URL, Config{MaxBytesPerSecond: 20000, BufferSize: 1000})
+	require.NoError(t, err)
+	go d.AsyncRun()
+	time.Sleep(100 * time.Millisecond)
+	d.Pause()
+	time.Sleep(500 * time.Millisecond)
+	remaining := 10000 - d.Completed()
+	require.True(t, remaining > 5000, "remaining: %d", remaining)
+
+	// The time spent paused can't be recovered with a burst
+	d.Resume()
+	start := time.Now()
+	<-d.Done
+	elapsed := time.Since(start)
+	require.NoError(t, d.Error())
+	require.Equal(t, int64(10000), d.Completed())
+	minElapsed := time.Duration(remaining-1000) * time.Second / 20000
+	require.True(t, elapsed >= minElapsed, "download too fast: %s, expected at least %s", elapsed, minElapsed)
+}
+
+func TestStats(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.Header().Set("Content-Length", "5000")
+		for i := 0; i < 5; i++ {
+			w.Write(bytes.Repeat([]byte{'a'}, 1000))
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	start := time.Now()
+	d, err := Download(tmpFile, server.URL)
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	elapsed := time.Since(start)
+
+	stats := d.Stats()
+	fmt.Println("STATS:", stats)
+	require.True(t, stats.SetupDuration >= 100*time.Millisecond)
+	require.True(t, stats.TransferDuration >= 150*time.Millisecond)
+	require.True(t, stats.SetupDuration+stats.TransferDuration <= elapsed)
+}
+
+func TestRunAndPollProgress(t *testing.T) {
+	server := newSlowServer(t, 10, 20*time.Millisecond)
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	d, err := Download(tmpFile, server.URL)
+	require.NoError(t, err)
+	var last Progress
+	maxSpeed := 0.0
+	err = d.RunAndPollProgress(func(p Progress) {
+		require.Equal(t, int64(10000), p.Size)
+		if p.Speed > maxSpeed {
+			maxSpeed = p.Speed
+		}
+		last = p
+	}, 50*time.Millisecond)
+	require.NoError(t, err)
+	require.True(t, maxSpeed > 0)
+	require.Equal(t, int64(10000), last.Current)
+	require.InDelta(t, 100, last.Percent, 0.01)
+	require.Equal(t, time.Duration(0), last.ETA)
+}
+
+func TestRunAndPollProgressUnknownSize(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte{'a'}, 1000))
+		w.(http.Flusher).Flush()
+	}))
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	d, err := Download(tmpFile, server.URL)
+	require.NoError(t, err)
+	err = d.RunAndPollProgress(func(p Progress) {
+		require.Equal(t, int64(-1), p.Size)
+		require.Equal(t, float64(-1), p.Percent)
+		require.Equal(t, time.Duration(0), p.ETA)
+	}, 10*time.Millisecond)
+	require.NoError(t, err)
+}
+
+func TestAppendMode(t *testing.T) {
+	data, err := os.ReadFile("testdata/test.txt")
+	require.NoError(t, err)
+	remote := data[:3000]
+	var requests int32
+	var rangeHeader atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		rangeHeader.Store(r.Header.Get("Range"))
+		http.ServeContent(w, r, "log.txt", time.Time{}, bytes.NewReader(remote))
+	}))
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	config := Config{
+		AppendMode: true,
+		CompleteCheck: func(path string, remoteSize int64, remoteETag string) (bool, error) {
+			return false, nil
+		},
+	}
+	require.NoError(t, Fetch(context.Background(), tmpFile, server.URL, config))
+	content, err := os.ReadFile(tmpFile)
+	require.NoError(t, err)
+	require.Equal(t, remote, content)
+
+	// The remote file grew: only the new bytes are downloaded
+	remote = data
+	d, err := DownloadWithConfig(tmpFile, server.URL, config)
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	require.Equal(t, "bytes=3000-", rangeHeader.Load())
+	requireSameAsTestFile(t, tmpFile)
+
+	// The remote file didn't change: nothing is downloaded
+	atomic.StoreInt32(&requests, 0)
+	d, err = DownloadWithConfig(tmpFile, server.URL, config)
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	require.Equal(t, int32(1), atomic.LoadInt32(&requests))
+	requireSameAsTestFile(t, tmpFile)
+}
+
+func TestResumeWithIfRange(t *testing.T) {
+	data, err := os.ReadFile("testdata/test.txt")
+	require.NoError(t, err)
+	changed := bytes.ToUpper(data)
+
+	test := func(t *testing.T, remoteChanged bool) {
+		var ifRange atomic.Value
+		ifRange.Store("")
+		etag, content := `"v1"`, data
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", etag)
+			if r.Header.Get("Range") == "" {
+				// Drop the connection in the middle of the first download
+				w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+				w.Write(content[:3000])
+				w.(http.Flusher).Flush()
+				panic(http.ErrAbortHandler)
+			}
+			ifRange.Store(r.Header.Get("If-Range"))
+			http.ServeContent(w, r, "test.txt", time.Time{}, bytes.NewReader(content))
+		}))
+		defer server.Close()
+		tmpFile := makeTmpFile(t)
+		defer os.Remove(tmpFile)
+		defer os.Remove(tmpFile + ".meta")
+
+		d, err := Download(tmpFile, server.URL)
+		require.NoError(t, err)
+		require.Error(t, d.Run())
+		require.Equal(t, &resumeMeta{URL: server.URL, ETag: `"v1"`}, loadResumeMeta(tmpFile))
+
+		if remoteChanged {
+			etag, content = `"v2"`, changed
+		}
+		d, err = Download(tmpFile, server.URL)
+		require.NoError(t, err)
+		require.NoError(t, d.Run())
+		require.Equal(t, `"v1"`, ifRange.Load())
+		require.Equal(t, !remoteChanged, d.resumed)
+		result, err := os.ReadFile(tmpFile)
+		require.NoError(t, err)
+		require.Equal(t, content, result)
+		_, err = os.Stat(tmpFile + ".meta")
+		require.True(t, os.IsNotExist(err))
+	}
+	t.Run("Unchanged", func(t *testing.T) { test(t, false) })
+	t.Run("Changed", func(t *testing.T) { test(t, true) })
+}
+
+func TestMaxConnectionAge(t *testing.T) {
+	data, err := os.ReadFile("testdata/test.txt")
+	require.NoError(t, err)
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		start := time.Now()
+		offset := 0
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &offset); err == nil {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, len(data)-1, len(data)))
+			w.Header().Set("Content-Length", fmt.Sprint(len(data)-offset))
+			w.WriteHeader(http.StatusPartialContent)
+		} else {
+			w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		}
+		for i := offset; i < len(data); i += 500 {
+			// The connections are dropped after 200ms
+			if time.Since(start) > 200*time.Millisecond {
+				panic(http.ErrAbortHandler)
+			}
+			end := i + 500
+			if end > len(data) {
+				end = len(data)
+			}
+			w.Write(data[i:end])
+			w.(http.Flusher).Flush()
+			time.Sleep(20 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	config := Config{MaxConnectionAge: 100 * time.Millisecond, ExpectedChecksum: testFileSHA256}
+	d, err := DownloadWithConfig(tmpFile, server.URL, config)
+	require.NoError(t, err)
+	// The response can be inspected while the download reconnects
+	require.NoError(t, d.RunAndPoll(func(current int64) {
+		_ = d.Header().Get("Content-Length")
+		_ = d.FinalURL()
+	}, time.Millisecond))
+	requireSameAsTestFile(t, tmpFile)
+	require.True(t, atomic.LoadInt32(&requests) >= 3)
+	require.Equal(t, fmt.Sprint(len(data)), d.Header().Get("Content-Length"))
+}
+
+func TestDownloadFromMirrors(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer failing.Close()
+	working := newTestFileServer(t)
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	d, err := DownloadFromMirrors(tmpFile, []string{failing.URL + "/test.txt", working.URL + "/test.txt"}, Config{})
+	require.NoError(t, err)
+	require.Equal(t, working.URL+"/test.txt", d.URL)
+	require.NoError(t, d.Run())
+	requireSameAsTestFile(t, tmpFile)
+
+	// All the mirrors fail
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+	_, err = DownloadFromMirrors(tmpFile, []string{failing.URL + "/test.txt", unreachable.URL}, Config{})
+	fmt.Println("ERROR:", err)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "mirror "+failing.URL+"/test.txt: server replied 404 Not Found")
+	require.Contains(t, err.Error(), "mirror "+unreachable.URL+": ")
+}
+
+func TestAtomic(t *testing.T) {
+	server := newSlowServer(t, 100, 10*time.Millisecond)
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+	defer os.Remove(tmpFile + ".download")
+
+	d, err := DownloadWithConfig(tmpFile, server.URL, Config{Atomic: true})
+	require.NoError(t, err)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		d.Cancel()
+	}()
+	require.Error(t, d.Run())
+	_, err = os.Stat(tmpFile)
+	require.True(t, os.IsNotExist(err))
+	info, err := os.Stat(tmpFile + ".download")
+	require.NoError(t, err)
+	require.Equal(t, d.Completed(), info.Size())
+
+	// The server doesn't support ranges, the temporary file is downloaded again
+	d, err = DownloadWithConfig(tmpFile, server.URL, Config{Atomic: true})
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	info, err = os.Stat(tmpFile)
+	require.NoError(t, err)
+	require.Equal(t, int64(100000), info.Size())
+	_, err = os.Stat(tmpFile + ".download")
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestAtomicResume(t *testing.T) {
+	server := newTestFileServer(t)
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+	defer os.Remove(tmpFile + ".download")
+
+	part, err := os.ReadFile("testdata/test.txt.part")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(tmpFile+".download", part, 0644))
+	d, err := DownloadWithConfig(tmpFile, server.URL+"/test.txt", Config{Atomic: true, ExpectedChecksum: testFileSHA256})
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	require.True(t, d.resumed)
+	requireSameAsTestFile(t, tmpFile)
+}
+
+func TestValidatorInFilename(t *testing.T) {
+	server := newTestFileServer(t)
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+	part, err := os.ReadFile("testdata/test.txt.part")
+	require.NoError(t, err)
+
+	// The partial download of the same version of the file is resumed
+	partial := partialPath(tmpFile, `"test"`)
+	require.NoError(t, os.WriteFile(partial, part, 0644))
+	d, err := DownloadWithConfig(tmpFile, server.URL+"/test.txt", Config{ValidatorInFilename: true})
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	require.True(t, d.resumed)
+	requireSameAsTestFile(t, tmpFile)
+	_, err = os.Stat(partial)
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(partial + ".meta")
+	require.True(t, os.IsNotExist(err))
+
+	// The partial download of another version is discarded
+	require.NoError(t, os.Remove(tmpFile))
+	stale := partialPath(tmpFile, `"other"`)
+	defer os.Remove(stale)
+	require.NoError(t, os.WriteFile(stale, part, 0644))
+	d, err = DownloadWithConfig(tmpFile, server.URL+"/test.txt", Config{ValidatorInFilename: true})
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	require.False(t, d.resumed)
+	requireSameAsTestFile(t, tmpFile)
+	_, err = os.Stat(stale)
+	require.True(t, os.IsNotExist(err))
+
+	// The files not created by the downloader are kept
+	require.NoError(t, os.Remove(tmpFile))
+	unrelated := []string{tmpFile + ".json.part", tmpFile + ".0123456789abcdeg.part", tmpFile + ".0123456789ABCDEF.part"}
+	for _, file := range unrelated {
+		defer os.Remove(file)
+		require.NoError(t, os.WriteFile(file, part, 0644))
+	}
+	d, err = DownloadWithConfig(tmpFile, server.URL+"/test.txt", Config{ValidatorInFilename: true})
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	requireSameAsTestFile(t, tmpFile)
+	for _, file := range unrelated {
+		_, err = os.Stat(file)
+		require.NoError(t, err)
+	}
+}
+
+func TestRetryInterruptedTransfer(t *testing.T) {
+	data, err := os.ReadFile("testdata/test.txt")
+	require.NoError(t, err)
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			// Send only part of the file, the connection is then dropped
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			_, _ = w.Write(data[:3000])
+			return
+		}
+		http.ServeContent(w, r, "test.txt", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	d, err := DownloadWithConfig(tmpFile, server.URL, Config{MaxRetries: 1, RetryDelay: time.Millisecond})
+	require.NoError(t, err)
+	updates := d.Subscribe(100)
+	progress := []int64{}
+	done := make(chan struct{})
+	go func() {
+		for completed := range updates {
+			progress = append(progress, completed)
+		}
+		close(done)
+	}()
+	require.NoError(t, d.Run())
+	<-done
+	requireSameAsTestFile(t, tmpFile)
+	require.Equal(t, int32(2), atomic.LoadInt32(&requests))
+	require.Equal(t, int64(len(data)), d.Completed())
+	require.NotEmpty(t, progress)
+	for i := 1; i < len(progress); i++ {
+		require.True(t, progress[i] >= progress[i-1], "progress decreased: %v", progress)
+	}
+	require.Equal(t, int64(len(data)), progress[len(progress)-1])
+
+	// Without retries the download fails
+	require.NoError(t, os.Remove(tmpFile))
+	atomic.StoreInt32(&requests, 0)
+	d, err = DownloadWithConfig(tmpFile, server.URL, Config{})
+	require.NoError(t, err)
+	require.Error(t, d.Run())
+}
+
+func TestExtraWriters(t *testing.T) {
+	server := newTestFileServer(t)
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	extra := &bytes.Buffer{}
+	d, err := DownloadWithConfig(tmpFile, server.URL+"/test.txt", Config{ExtraWriters: []io.Writer{extra}})
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	requireSameAsTestFile(t, tmpFile)
+	content, err := os.ReadFile(tmpFile)
+	require.NoError(t, err)
+	require.Equal(t, content, extra.Bytes())
+
+	require.NoError(t, os.Remove(tmpFile))
+	d, err = DownloadWithConfig(tmpFile, server.URL+"/test.txt", Config{ExtraWriters: []io.Writer{&failingWriter{limit: 100, err: errors.New("extra writer failure")}}})
+	require.NoError(t, err)
+	err = d.Run()
+	require.Error(t, err)
+	require.Equal(t, err, d.Error())
+	require.Contains(t, err.Error(), "extra writer failure")
+}
+
+type memoryFile struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (f *memoryFile) Close() error {
+	f.closed = true
+	return nil
+}
+
+func TestOpenFunc(t *testing.T) {
+	server := newTestFileServer(t)
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	out := &memoryFile{}
+	var resuming []bool
+	config := Config{
+		OpenFunc: func(path string, resume bool) (io.WriteCloser, error) {
+			require.Equal(t, tmpFile, path)
+			resuming = append(resuming, resume)
+			return out, nil
+		},
+	}
+	d, err := DownloadWithConfig(tmpFile, server.URL+"/test.txt", config)
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	require.True(t, out.closed)
+	data, err := os.ReadFile("testdata/test.txt")
+	require.NoError(t, err)
+	require.Equal(t, data, out.Bytes())
+	_, err = os.Stat(tmpFile)
+	require.True(t, os.IsNotExist(err))
+
+	// The partial download is resumed appending to the custom output
+	part, err := os.ReadFile("testdata/test.txt.part")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(tmpFile, part, 0644))
+	out = &memoryFile{}
+	out.Write(part)
+	d, err = DownloadWithConfig(tmpFile, server.URL+"/test.txt", config)
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	require.Equal(t, []bool{false, true}, resuming)
+	require.Equal(t, data, out.Bytes())
+
+	// Parallel downloads require an io.WriterAt
+	require.NoError(t, os.Remove(tmpFile))
+	_, err = DownloadParallel(tmpFile, server.URL+"/test.txt", 2, config)
+	require.Error(t, err)
+
+	// OnClose requires an *os.File
+	out = &memoryFile{}
+	closed := false
+	config.OnClose = func(f *os.File) error {
+		closed = true
+		return nil
+	}
+	_, err = DownloadWithConfig(tmpFile, server.URL+"/test.txt", config, NoResume)
+	require.Error(t, err)
+	fmt.Println("ERROR:", err)
+	require.True(t, out.closed)
+	config.OpenFunc = func(path string, resume bool) (io.WriteCloser, error) {
+		return os.Create(path)
+	}
+	d, err = DownloadWithConfig(tmpFile, server.URL+"/test.txt", config, NoResume)
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	require.True(t, closed)
+	requireSameAsTestFile(t, tmpFile)
+}
+
+func TestNoResumeInDefaultConfig(t *testing.T) {
+	var rangeHeader atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rangeHeader.Store(r.Header.Get("Range"))
+		http.ServeFile(w, r, "testdata/test.txt")
+	}))
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+	part, err := os.ReadFile("testdata/test.txt.part")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(tmpFile, part, 0644))
+
+	defaultConfig := GetDefaultConfig()
+	defer SetDefaultConfig(defaultConfig)
+	SetDefaultConfig(Config{NoResume: true})
+
+	d, err := Download(tmpFile, server.URL)
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	require.Equal(t, "", rangeHeader.Load())
+	require.False(t, d.resumed)
+	requireSameAsTestFile(t, tmpFile)
+}
+
+func TestStrictRedirectConsistency(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			http.Redirect(w, r, "/a", http.StatusFound)
+		} else {
+			http.Redirect(w, r, "/b", http.StatusFound)
+		}
+	})
+	mux.HandleFunc("/stable", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/a", http.StatusFound)
+	})
+	for path, code := range map[string]int{"/nohead": http.StatusMethodNotAllowed, "/forbiddenhead": http.StatusForbidden} {
+		code := code
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "HEAD" {
+				w.WriteHeader(code)
+				return
+			}
+			http.Redirect(w, r, "/b", http.StatusFound)
+		})
+	}
+	serveTestFile := func(w http.ResponseWriter, r *http.Request) { http.ServeFile(w, r, "testdata/test.txt") }
+	mux.HandleFunc("/a", serveTestFile)
+	mux.HandleFunc("/b", serveTestFile)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	config := Config{StrictRedirectConsistency: true}
+	_, err := DownloadWithConfig(tmpFile, server.URL+"/file", config)
+	fmt.Println("ERROR:", err)
+	require.True(t, errors.Is(err, ErrRedirectChanged))
+
+	d, err := DownloadWithConfig(tmpFile, server.URL+"/stable", config)
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	requireSameAsTestFile(t, tmpFile)
+
+	// The check is skipped if the HEAD request fails
+	for _, path := range []string{"/nohead", "/forbiddenhead"} {
+		d, err = DownloadWithConfig(tmpFile, server.URL+path, config, NoResume)
+		require.NoError(t, err)
+		require.NoError(t, d.Run())
+		requireSameAsTestFile(t, tmpFile)
+	}
+
+	// Without the option the download proceeds
+	d, err = DownloadWithConfig(tmpFile, server.URL+"/file", Config{}, NoResume)
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	requireSameAsTestFile(t, tmpFile)
+}
+
+func TestBufferSize(t *testing.T) {
+	server := newTestFileServer(t)
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	d, err := DownloadWithConfig(tmpFile, server.URL+"/test.txt", Config{BufferSize: 1024 * 1024})
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	requireSameAsTestFile(t, tmpFile)
+
+	d, err = DownloadWithConfig(tmpFile, server.URL+"/test.txt", Config{BufferSize: -1}, NoResume)
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	requireSameAsTestFile(t, tmpFile)
+}
+
+func BenchmarkBufferSize(b *testing.B) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4*1024*1024)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "data", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	for _, size := range []int{4 * 1024, 1024 * 1024} {
+		b.Run(fmt.Sprintf("%dKiB", size/1024), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				d, err := DownloadToWriter(io.Discard, server.URL, Config{BufferSize: size})
+				require.NoError(b, err)
+				require.NoError(b, d.Run())
+			}
+		})
+	}
+}
+
+func TestHTTPStatusError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/notfound":
+			http.NotFound(w, r)
+		case "/error":
+			http.Error(w, "internal error", http.StatusInternalServerError)
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, "<html></html>")
+		}
+	}))
+	defer server.Close()
+
+	for _, test := range []struct {
+		path string
+		code int
+	}{{"/notfound", 404}, {"/error", 500}} {
+		tmpFile := makeTmpFile(t)
+		_, err := Download(tmpFile, server.URL+test.path)
+		fmt.Println("ERROR:", err)
+		var statusErr *HTTPStatusError
+		require.True(t, errors.As(err, &statusErr))
+		require.Equal(t, test.code, statusErr.Code)
+		_, err = os.Stat(tmpFile)
+		require.True(t, os.IsNotExist(err))
+	}
+
+	tmpFile := makeTmpFile(t)
+	errHTML := errors.New("html content")
+	config := Config{
+		AcceptFunc: func(resp *http.Response) error {
+			if resp.Header.Get("Content-Type") == "text/html" {
+				return errHTML
+			}
+			return nil
+		},
+	}
+	_, err := DownloadWithConfig(tmpFile, server.URL+"/page", config)
+	require.Equal(t, errHTML, err)
+	_, err = os.Stat(tmpFile)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestAllowedHosts(t *testing.T) {
+	server := newTestFileServer(t)
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, strings.Replace(server.URL, "127.0.0.1", "localhost", 1)+"/test.txt", http.StatusFound)
+	}))
+	defer redirect.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	// Allowed
+	d, err := DownloadWithConfig(tmpFile, server.URL+"/test.txt", Config{AllowedHosts: []string{"example.com", "127.0.0.1"}})
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	requireSameAsTestFile(t, tmpFile)
+
+	// Blocked
+	_, err = DownloadWithConfig(tmpFile, server.URL+"/test.txt", Config{AllowedHosts: []string{"*.example.com"}}, NoResume)
+	fmt.Println("ERROR:", err)
+	require.True(t, errors.Is(err, ErrHostNotAllowed))
+
+	// Redirect to a blocked host
+	_, err = DownloadWithConfig(tmpFile, redirect.URL, Config{AllowedHosts: []string{"127.0.0.1"}}, NoResume)
+	fmt.Println("ERROR:", err)
+	require.True(t, errors.Is(err, ErrHostNotAllowed))
+}
+
+func TestCheckHost(t *testing.T) {
+	config := Config{AllowedHosts: []string{"downloads.example.org", "*.Example.com"}}
+	for host, allowed := range map[string]bool{
+		"http://downloads.example.org/file":  true,
+		"http://DOWNLOADS.example.org:8080/": true,
+		"http://cdn.example.com/file":        true,
+		"http://a.b.example.com/file":        true,
+		"http://example.com/file":            false,
+		"http://badexample.com/file":         false,
+		"http://example.org/file":            false,
+	} {
+		u, err := url.Parse(host)
+		require.NoError(t, err)
+		require.Equal(t, allowed, config.checkHost(u) == nil, host)
+	}
+	require.NoError(t, (&Config{}).checkHost(&url.URL{Host: "anything"}))
+}
+
+func TestWarnings(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		http.ServeFile(w, r, "testdata/test.txt")
+	}))
+	defer server.Close()
+	failing := httptest.NewServer(http.NotFoundHandler())
+	defer failing.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	config := Config{MaxRetries: 3, RetryDelay: time.Millisecond}
+	d, err := DownloadFromMirrors(tmpFile, []string{failing.URL, server.URL}, config)
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	requireSameAsTestFile(t, tmpFile)
+
+	warnings := []error{}
+	for w := range d.Warnings() {
+		fmt.Println("WARNING:", w)
+		warnings = append(warnings, w)
+	}
+	require.Len(t, warnings, 3)
+	var statusErr *HTTPStatusError
+	require.True(t, errors.As(warnings[0], &statusErr))
+	require.Equal(t, 404, statusErr.Code)
+	require.Contains(t, warnings[1].Error(), "502 Bad Gateway")
+	require.Contains(t, warnings[2].Error(), "502 Bad Gateway")
+}
+
+func TestProgressUpdateBytes(t *testing.T) {
+	server := newTestFileServer(t)
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	rate := &fixedRateEstimator{}
+	config := Config{ProgressUpdateBytes: 3000, RateEstimator: rate}
+	d, err := DownloadWithConfig(tmpFile, server.URL+"/test.txt", config)
+	require.NoError(t, err)
+	updates := d.Subscribe(100)
+	require.NoError(t, d.Run())
+	requireSameAsTestFile(t, tmpFile)
+	require.Equal(t, int64(8052), d.Completed())
+	require.Equal(t, int64(8052), d.Downloaded())
+	require.Equal(t, int64(8052), rate.observed)
+	// The initial observation, then every 3000 bytes and at the end
+	require.True(t, rate.calls <= 4, "too many updates: %d", rate.calls)
+	last := int64(0)
+	for u := range updates {
+		require.True(t, u-last >= 3000 || u == 8052)
+		last = u
+	}
+	require.Equal(t, int64(8052), last)
+}
+
+func BenchmarkProgressUpdateBytes(b *testing.B) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4*1024*1024)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "data", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	for _, updateBytes := range []int64{0, 1024 * 1024} {
+		b.Run(fmt.Sprintf("%dKiB", updateBytes/1024), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			updates := 0
+			for i := 0; i < b.N; i++ {
+				rate := &fixedRateEstimator{}
+				d, err := DownloadToWriter(io.Discard, server.URL, Config{ProgressUpdateBytes: updateBytes, RateEstimator: rate})
+				require.NoError(b, err)
+				require.NoError(b, d.Run())
+				require.Equal(b, int64(len(data)), d.Completed())
+				updates += rate.calls
+			}
+			b.ReportMetric(float64(updates)/float64(b.N), "updates/op")
+		})
+	}
+}
+
+func TestShortDownload(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "8052")
+		w.Write(bytes.Repeat([]byte{'a'}, 6000))
+	}))
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	d, err := Download(tmpFile, server.URL)
+	require.NoError(t, err)
+	err = d.Run()
+	fmt.Println("ERROR:", err)
+	var short *ShortDownloadError
+	require.True(t, errors.As(err, &short))
+	require.Equal(t, &ShortDownloadError{Expected: 8052, Got: 6000}, short)
+
+	// Unknown size
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte{'a'}, 6000))
+		w.(http.Flusher).Flush()
+	}))
+	defer server.Close()
+	d, err = Download(tmpFile, server.URL, NoResume)
+	require.NoError(t, err)
+	require.Equal(t, int64(-1), d.Size())
+	require.NoError(t, d.Run())
+}
+
+func TestDownloadParallelResumeWithDifferentConnections(t *testing.T) {
+	data, err := os.ReadFile("testdata/test.txt")
+	require.NoError(t, err)
+	var requested int64
+	var slow int32 = 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"test"`)
+		var start, end int
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err != nil {
+			http.ServeContent(w, r, "test.txt", time.Time{}, bytes.NewReader(data))
+			return
+		}
+		atomic.AddInt64(&requested, int64(end-start+1))
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		w.Header().Set("Content-Length", fmt.Sprint(end-start+1))
+		w.WriteHeader(http.StatusPartialContent)
+		for i := start; i <= end; i += 100 {
+			chunk := data[i:]
+			if len(chunk) > 100 {
+				chunk = chunk[:100]
+			}
+			if i+len(chunk) > end+1 {
+				chunk = chunk[:end+1-i]
+			}
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			if atomic.LoadInt32(&slow) == 1 {
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+	}))
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+	defer os.Remove(tmpFile + ".segments")
+
+	// Interrupt a download with 4 connections
+	d, err := DownloadParallel(tmpFile, server.URL, 4, Config{})
+	require.NoError(t, err)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		d.Cancel()
+	}()
+	require.Error(t, d.Run())
+	interrupted := d.Completed()
+	require.True(t, interrupted > 0 && interrupted < int64(len(data)))
+	meta := loadSegmentsMeta(tmpFile)
+	require.NotNil(t, meta)
+	require.Len(t, meta.Done, 4)
+
+	// Resume with 2 connections
+	atomic.StoreInt32(&slow, 0)
+	atomic.StoreInt64(&requested, 0)
+	d, err = DownloadParallel(tmpFile, server.URL, 2, Config{ExpectedChecksum: testFileSHA256})
+	require.NoError(t, err)
+	require.Equal(t, interrupted, d.Completed())
+	require.NoError(t, d.Run())
+	requireSameAsTestFile(t, tmpFile)
+	require.Equal(t, int64(len(data))-interrupted, atomic.LoadInt64(&requested))
+	_, err = os.Stat(tmpFile + ".segments")
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestMissingRanges(t *testing.T) {
+	require.Equal(t, []byteRange{{0, 99}}, missingRanges(nil, 100))
+	require.Equal(t, []byteRange{{10, 19}, {50, 99}}, missingRanges([]byteRange{{20, 49}, {0, 9}}, 100))
+	require.Equal(t, []byteRange{}, missingRanges([]byteRange{{0, 50}, {40, 99}}, 100))
+	segments := splitRanges([]byteRange{{10, 19}, {50, 99}}, 2)
+	require.Len(t, segments, 3)
+	require.Equal(t, byteRange{10, 19}, segments[0].byteRange)
+	require.Equal(t, byteRange{50, 79}, segments[1].byteRange)
+	require.Equal(t, byteRange{80, 99}, segments[2].byteRange)
+}
+
+func TestPreserveModTime(t *testing.T) {
+	data, err := os.ReadFile("testdata/test.txt")
+	require.NoError(t, err)
+	modTime := time.Date(2020, 5, 6, 7, 8, 9, 0, time.UTC)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "test.txt", modTime, bytes.NewReader(data))
+	}))
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	require.NoError(t, Fetch(context.Background(), tmpFile, server.URL, Config{PreserveModTime: true}))
+	info, err := os.Stat(tmpFile)
+	require.NoError(t, err)
+	require.True(t, modTime.Equal(info.ModTime()), "got %s", info.ModTime())
+
+	require.NoError(t, Fetch(context.Background(), tmpFile, server.URL, Config{}, NoResume))
+	info, err = os.Stat(tmpFile)
+	require.NoError(t, err)
+	require.False(t, modTime.Equal(info.ModTime()))
+}
+
+func TestRetryAfter(t *testing.T) {
+	test := func(t *testing.T, retryAfter func() string, minDelay time.Duration) {
+		var requestsLock sync.Mutex
+		requests := []time.Time{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestsLock.Lock()
+			requests = append(requests, time.Now())
+			first := len(requests) == 1
+			requestsLock.Unlock()
+			if first {
+				w.Header().Set("Retry-After", retryAfter())
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			http.ServeFile(w, r, "testdata/test.txt")
+		}))
+		defer server.Close()
+		tmpFile := makeTmpFile(t)
+		defer os.Remove(tmpFile)
+
+		config := Config{MaxRetries: 1, RetryDelay: time.Millisecond}
+		require.NoError(t, Fetch(context.Background(), tmpFile, server.URL, config))
+		requireSameAsTestFile(t, tmpFile)
+		require.Len(t, requests, 2)
+		require.True(t, requests[1].Sub(requests[0]) >= minDelay, "retried after %s", requests[1].Sub(requests[0]))
+	}
+	t.Run("Seconds", func(t *testing.T) {
+		test(t, func() string { return "1" }, time.Second)
+	})
+	t.Run("Date", func(t *testing.T) {
+		test(t, func() string { return time.Now().Add(2 * time.Second).UTC().Format(http.TimeFormat) }, time.Second)
+	})
+	t.Run("Exhausted", func(t *testing.T) {
+		var requests int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}))
+		defer server.Close()
+		tmpFile := makeTmpFile(t)
+		defer os.Remove(tmpFile)
+
+		err := Fetch(context.Background(), tmpFile, server.URL, Config{MaxRetries: 2})
+		var statusErr *HTTPStatusError
+		require.True(t, errors.As(err, &statusErr))
+		require.Equal(t, http.StatusTooManyRequests, statusErr.Code)
+		require.Equal(t, int32(3), atomic.LoadInt32(&requests))
+	})
+}
+
+func TestOnClose(t *testing.T) {
+	server := newTestFileServer(t)
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	called := 0
+	config := Config{OnClose: func(f *os.File) error {
+		called++
+		return f.Chmod(0600)
+	}}
+	require.NoError(t, Fetch(context.Background(), tmpFile, server.URL+"/test.txt", config))
+	requireSameAsTestFile(t, tmpFile)
+	require.Equal(t, 1, called)
+	info, err := os.Stat(tmpFile)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	hookErr := errors.New("hook failed")
+	config = Config{OnClose: func(f *os.File) error { return hookErr }}
+	err = Fetch(context.Background(), tmpFile, server.URL+"/test.txt", config, NoResume)
+	require.Equal(t, hookErr, err)
+}
+
+func TestSkipIfUnmodified(t *testing.T) {
+	data, err := os.ReadFile("testdata/test.txt")
+	require.NoError(t, err)
+	modTime := time.Date(2020, 5, 6, 7, 8, 9, 0, time.UTC)
+	var notModified int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-Modified-Since") != "" {
+			atomic.AddInt32(&notModified, 1)
+		}
+		http.ServeContent(w, r, "test.txt", modTime, bytes.NewReader(data))
+	}))
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+	defer os.Remove(tmpFile + ".modified")
+
+	config := Config{SkipIfUnmodified: true}
+	d, err := DownloadWithConfig(tmpFile, server.URL, config)
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	require.False(t, d.NotModified())
+	requireSameAsTestFile(t, tmpFile)
+	require.FileExists(t, tmpFile+".modified")
+
+	// Mark the file to check that it's not rewritten
+	marker := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, os.Chtimes(tmpFile, marker, marker))
+
+	d, err = DownloadWithConfig(tmpFile, server.URL, config)
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	require.True(t, d.NotModified())
+	require.Equal(t, int32(1), atomic.LoadInt32(&notModified))
+	require.Equal(t, int64(len(data)), d.Completed())
+	info, err := os.Stat(tmpFile)
+	require.NoError(t, err)
+	require.True(t, marker.Equal(info.ModTime()))
+	requireSameAsTestFile(t, tmpFile)
+
+	// The file changed on the server
+	modTime = modTime.Add(time.Hour)
+	d, err = DownloadWithConfig(tmpFile, server.URL, config)
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	require.False(t, d.NotModified())
+	info, err = os.Stat(tmpFile)
+	require.NoError(t, err)
+	require.False(t, marker.Equal(info.ModTime()))
+	requireSameAsTestFile(t, tmpFile)
+}
+
+func TestNoFollowSymlinks(t *testing.T) {
+	server := newTestFileServer(t)
+	defer server.Close()
+	dir, err := os.MkdirTemp("", "downloader")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	target := filepath.Join(dir, "target.txt")
+	link := filepath.Join(dir, "link.txt")
+	require.NoError(t, os.WriteFile(target, []byte("original"), 0644))
+	if err := os.Symlink(target, link); err != nil {
+		t.Skip("symbolic links not supported:", err)
+	}
+
+	t.Run("Reject", func(t *testing.T) {
+		err := Fetch(context.Background(), link, server.URL+"/test.txt", Config{NoFollowSymlinks: true}, NoResume)
+		fmt.Println("ERROR:", err)
+		require.True(t, errors.Is(err, ErrUnexpectedSymlink))
+		data, err := os.ReadFile(target)
+		require.NoError(t, err)
+		require.Equal(t, "original", string(data))
+	})
+	t.Run("Open", func(t *testing.T) {
+		// A link created after the check is rejected when the file is opened
+		config := Config{NoFollowSymlinks: true}
+		_, err := config.openFile(link, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, false)
+		fmt.Println("ERROR:", err)
+		require.True(t, errors.Is(err, ErrUnexpectedSymlink))
+		data, err := os.ReadFile(target)
+		require.NoError(t, err)
+		require.Equal(t, "original", string(data))
+	})
+	t.Run("Follow", func(t *testing.T) {
+		require.NoError(t, Fetch(context.Background(), link, server.URL+"/test.txt", Config{}, NoResume))
+		requireSameAsTestFile(t, target)
+		info, err := os.Lstat(link)
+		require.NoError(t, err)
+		require.True(t, info.Mode()&os.ModeSymlink != 0)
+	})
+}
+
+func TestLogProgress(t *testing.T) {
+	server := newSlowServer(t, 10, 50*time.Millisecond)
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	logs := &syncBuffer{}
+	config := Config{
+		LogProgress:     true,
+		Logger:          slog.New(slog.NewTextHandler(logs, nil)),
+		MinPollInterval: 100 * time.Millisecond,
+	}
+	require.NoError(t, Fetch(context.Background(), tmpFile, server.URL, config))
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	require.True(t, len(lines) >= 2, "got %d progress lines", len(lines))
+	for _, line := range lines {
+		require.Contains(t, line, "level=INFO")
+		require.Contains(t, line, "downloading "+server.URL)
+		require.Contains(t, line, "path="+tmpFile)
+	}
+
+	// Without a Logger nothing is logged
+	require.NoError(t, Fetch(context.Background(), tmpFile, server.URL, Config{LogProgress: true}, NoResume))
+}
+
+func TestTypedErrors(t *testing.T) {
+	data, err := os.ReadFile("testdata/test.txt")
+	require.NoError(t, err)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/test.txt":
+			http.ServeContent(w, r, "test.txt", time.Time{}, bytes.NewReader(data))
+		case "/noranges.txt":
+			_, _ = w.Write(data)
+		case "/short.txt":
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			_, _ = w.Write(data[:1000])
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	t.Run("HTTPStatusError", func(t *testing.T) {
+		err := Fetch(context.Background(), tmpFile, server.URL+"/notfound.txt", Config{}, NoResume)
+		fmt.Println("ERROR:", err)
+		var statusErr *HTTPStatusError
+		require.True(t, errors.As(err, &statusErr))
+		require.Equal(t, http.StatusNotFound, statusErr.Code)
+	})
+	t.Run("ChecksumMismatchError", func(t *testing.T) {
+		config := Config{ExpectedChecksum: "sha256:0000000000000000000000000000000000000000000000000000000000000000"}
+		err := Fetch(context.Background(), tmpFile, server.URL+"/test.txt", config, NoResume)
+		fmt.Println("ERROR:", err)
+		var mismatch *ChecksumMismatchError
+		require.True(t, errors.As(err, &mismatch))
+	})
+	t.Run("ShortDownloadError", func(t *testing.T) {
+		err := Fetch(context.Background(), tmpFile, server.URL+"/short.txt", Config{}, NoResume)
+		fmt.Println("ERROR:", err)
+		var short *ShortDownloadError
+		require.True(t, errors.As(err, &short))
+		require.Equal(t, int64(len(data)), short.Expected)
+	})
+	t.Run("ErrRangeNotSupported", func(t *testing.T) {
+		_, _, err := OpenRange(context.Background(), server.URL+"/noranges.txt", 0, 99, Config{})
+		fmt.Println("ERROR:", err)
+		require.True(t, errors.Is(err, ErrRangeNotSupported))
+	})
+}
+
+func TestHeaderAndFinalURL(t *testing.T) {
+	fileServer := newTestFileServer(t)
+	defer fileServer.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, fileServer.URL+"/test.txt", http.StatusFound)
+	}))
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	d, err := Download(tmpFile, server.URL+"/download")
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	requireSameAsTestFile(t, tmpFile)
+	require.Equal(t, server.URL+"/download", d.URL)
+	require.Equal(t, fileServer.URL+"/test.txt", d.FinalURL())
+	require.Equal(t, `"test"`, d.Header().Get("ETag"))
+	require.Equal(t, "text/plain; charset=utf-8", d.Header().Get("Content-Type"))
+}
+
+func TestProgressJSONWriter(t *testing.T) {
+	server := newSlowServer(t, 10, 50*time.Millisecond)
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	out := &syncBuffer{}
+	config := Config{
+		ProgressJSONWriter: out,
+		MinPollInterval:    100 * time.Millisecond,
+	}
+	require.NoError(t, Fetch(context.Background(), tmpFile, server.URL, config))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.True(t, len(lines) >= 3, "got %d events", len(lines))
+	prev := int64(-1)
+	for i, line := range lines {
+		var event map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(line), &event), line)
+		for _, key := range []string{"completed", "total", "bps", "eta", "state"} {
+			require.Contains(t, event, key)
+		}
+		completed := int64(event["completed"].(float64))
+		require.True(t, completed >= prev, "completion decreased: %s", line)
+		prev = completed
+		if i < len(lines)-1 {
+			require.Equal(t, "running", event["state"])
+		} else {
+			require.Equal(t, "completed", event["state"])
+			require.Equal(t, float64(10000), event["completed"])
+		}
+	}
+}
+
+func TestCheckFreeSpace(t *testing.T) {
+	server := newTestFileServer(t)
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	free, err := freeSpace(os.TempDir())
+	require.NoError(t, err)
+	require.True(t, free != 0)
+
+	available := int64(1000)
+	defer func(f func(string) (int64, error)) { freeSpace = f }(freeSpace)
+	freeSpace = func(dir string) (int64, error) {
+		require.Equal(t, filepath.Dir(tmpFile), dir)
+		return available, nil
+	}
+
+	config := Config{CheckFreeSpace: true}
+	_, err = DownloadWithConfig(tmpFile, server.URL+"/test.txt", config)
+	fmt.Println("ERROR:", err)
+	var spaceErr *InsufficientSpaceError
+	require.True(t, errors.As(err, &spaceErr))
+	require.Equal(t, int64(8052), spaceErr.Required)
+	require.Equal(t, int64(1000), spaceErr.Available)
+	_, err = os.Stat(tmpFile)
+	require.True(t, os.IsNotExist(err))
+
+	// The check is disabled by default
+	require.NoError(t, Fetch(context.Background(), tmpFile, server.URL+"/test.txt", Config{}))
+	requireSameAsTestFile(t, tmpFile)
+
+	available = 1 << 30
+	require.NoError(t, Fetch(context.Background(), tmpFile, server.URL+"/test.txt", config, NoResume))
+	requireSameAsTestFile(t, tmpFile)
+}
+
+func TestMaxSize(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/test.txt" {
+			http.ServeFile(w, r, "testdata/test.txt")
+			return
+		}
+		// Chunked response that never ends
+		chunk := bytes.Repeat([]byte{'a'}, 1000)
+		for r.Context().Err() == nil {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	config := Config{MaxSize: 50000}
+	d, err := DownloadWithConfig(tmpFile, server.URL+"/endless", config, NoResume)
+	require.NoError(t, err)
+	err = d.RunWithTimeout(10 * time.Second)
+	fmt.Println("ERROR:", err)
+	var maxErr *MaxSizeExceededError
+	require.True(t, errors.As(err, &maxErr))
+	require.Equal(t, int64(50000), maxErr.Limit)
+	info, err := os.Stat(tmpFile)
+	require.NoError(t, err)
+	require.True(t, info.Size() <= 50000, "written %d bytes", info.Size())
+	require.True(t, info.Size() > 40000, "written %d bytes", info.Size())
+
+	// The size announced by the server is rejected up-front
+	_, err = DownloadWithConfig(tmpFile, server.URL+"/test.txt", Config{MaxSize: 8000}, NoResume)
+	fmt.Println("ERROR:", err)
+	require.True(t, errors.As(err, &maxErr))
+	require.NoError(t, Fetch(context.Background(), tmpFile, server.URL+"/test.txt", Config{MaxSize: 8052}, NoResume))
+	requireSameAsTestFile(t, tmpFile)
+}
+
+func TestBlobStore(t *testing.T) {
+	data, err := os.ReadFile("testdata/test.txt")
+	require.NoError(t, err)
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		_, _ = w.Write(data)
+	}))
+	defer server.Close()
+	dir, err := os.MkdirTemp("", "downloader")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store := NewBlobStore(filepath.Join(dir, "blobs"), Config{})
+	blob := filepath.Join(dir, "blobs", "sha256", strings.TrimPrefix(testFileSHA256, "sha256:"))
+
+	// Miss: the content is downloaded and stored
+	a := filepath.Join(dir, "a.txt")
+	downloaded, err := store.Fetch(context.Background(), a, server.URL+"/a", "")
+	require.NoError(t, err)
+	require.True(t, downloaded)
+	requireSameAsTestFile(t, a)
+	require.FileExists(t, blob)
+
+	// Same content from another url: the blob is shared
+	b := filepath.Join(dir, "b.txt")
+	downloaded, err = store.Fetch(context.Background(), b, server.URL+"/b", "")
+	require.NoError(t, err)
+	require.True(t, downloaded)
+	require.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	// Hit: the checksum is known, nothing is downloaded
+	c := filepath.Join(dir, "c.txt")
+	downloaded, err = store.Fetch(context.Background(), c, server.URL+"/c", testFileSHA256)
+	require.NoError(t, err)
+	require.False(t, downloaded)
+	require.Equal(t, int32(2), atomic.LoadInt32(&requests))
+	requireSameAsTestFile(t, c)
+
+	blobInfo, err := os.Stat(blob)
+	require.NoError(t, err)
+	for _, file := range []string{a, b, c} {
+		info, err := os.Stat(file)
+		require.NoError(t, err)
+		require.True(t, os.SameFile(blobInfo, info), file)
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, "blobs", "sha256"))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	// Miss with a wrong checksum: nothing is stored
+	_, err = store.Fetch(context.Background(), filepath.Join(dir, "d.txt"), server.URL+"/d", "md5:00000000000000000000000000000000")
+	var mismatch *ChecksumMismatchError
+	require.True(t, errors.As(err, &mismatch))
+	_, err = os.Stat(filepath.Join(dir, "blobs", "md5"))
+	require.True(t, os.IsNotExist(err))
+
+	// A digest that isn't a valid hex digest is rejected before any request
+	for _, checksum := range []string{"sha256:../../x", "sha256:" + strings.Repeat("0", 63), "sha256:" + strings.Repeat("g", 64)} {
+		_, err = store.Fetch(context.Background(), filepath.Join(dir, "e.txt"), server.URL+"/e", checksum)
+		require.Error(t, err)
+		fmt.Println("ERROR:", err)
+	}
+	require.Equal(t, int32(3), atomic.LoadInt32(&requests))
+}
+
+func TestCompressionModes(t *testing.T) {
+	data, err := os.ReadFile("testdata/test.txt")
+	require.NoError(t, err)
+	gzipped := gzipData(t, data)
+	var acceptLock sync.Mutex
+	accept := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acceptLock.Lock()
+		accept = r.Header.Get("Accept-Encoding")
+		acceptLock.Unlock()
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Set("Content-Length", strconv.Itoa(len(gzipped)))
+			_, _ = w.Write(gzipped)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		_, _ = w.Write(data)
+	}))
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+	lastAccept := func() string {
+		acceptLock.Lock()
+		defer acceptLock.Unlock()
+		return accept
+	}
+
+	t.Run("DisableCompression", func(t *testing.T) {
+		d, err := DownloadWithConfig(tmpFile, server.URL, Config{DisableCompression: true, Decompress: true}, NoResume)
+		require.NoError(t, err)
+		require.Equal(t, "identity", lastAccept())
+		require.Equal(t, int64(len(data)), d.Size())
+		require.NoError(t, d.Run())
+		require.Equal(t, int64(len(data)), d.Completed())
+		requireSameAsTestFile(t, tmpFile)
+	})
+	t.Run("Decompress", func(t *testing.T) {
+		d, err := DownloadWithConfig(tmpFile, server.URL, Config{Decompress: true}, NoResume)
+		require.NoError(t, err)
+		require.Equal(t, "gzip", lastAccept())
+		require.Equal(t, int64(-1), d.Size())
+		require.NoError(t, d.Run())
+		require.Equal(t, int64(len(data)), d.Completed())
+		requireSameAsTestFile(t, tmpFile)
+	})
+}
+
+func TestPinnedCertSHA256(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "testdata/test.txt")
+	}))
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	// Trust the certificate of the test server
+	defaultTransport := http.DefaultTransport.(*http.Transport)
+	defer func(c *tls.Config) { defaultTransport.TLSClientConfig = c }(defaultTransport.TLSClientConfig)
+	defaultTransport.TLSClientConfig = server.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+
+	cert := server.Certificate()
+	for _, pin := range [][32]byte{sha256.Sum256(cert.Raw), sha256.Sum256(cert.RawSubjectPublicKeyInfo)} {
+		config := Config{PinnedCertSHA256: [][32]byte{sha256.Sum256([]byte("other")), pin}}
+		require.NoError(t, Fetch(context.Background(), tmpFile, server.URL, config, NoResume))
+		requireSameAsTestFile(t, tmpFile)
+	}
+
+	config := Config{PinnedCertSHA256: [][32]byte{sha256.Sum256([]byte("other"))}, MaxRetries: 3}
+	_, err := DownloadWithConfig(tmpFile, server.URL, config, NoResume)
+	fmt.Println("ERROR:", err)
+	require.True(t, errors.Is(err, ErrCertPinMismatch))
+}
+
+func TestFileURL(t *testing.T) {
+	src, err := filepath.Abs("testdata/test.txt")
+	require.NoError(t, err)
+	srcURL := (&url.URL{Scheme: "file", Path: filepath.ToSlash(src)}).String()
+	if !strings.HasPrefix(srcURL, "file:///") {
+		srcURL = strings.Replace(srcURL, "file://", "file:///", 1)
+	}
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	// The file urls must be enabled
+	_, err = Download(tmpFile, srcURL)
+	require.Error(t, err)
+	fmt.Println("ERROR:", err)
+
+	config := Config{AllowFileURLs: true}
+	d, err := DownloadWithConfig(tmpFile, srcURL, config)
+	require.NoError(t, err)
+	require.Equal(t, int64(8052), d.Size())
+	polled := false
+	require.NoError(t, d.RunAndPoll(func(current int64) { polled = true }, time.Millisecond))
+	require.True(t, polled)
+	requireSameAsTestFile(t, tmpFile)
+
+	// Resume
+	part, err := os.ReadFile("testdata/test.txt.part")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(tmpFile, part, 0644))
+	d, err = DownloadWithConfig(tmpFile, srcURL, config)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(part)), d.Completed())
+	require.NoError(t, d.Run())
+	requireSameAsTestFile(t, tmpFile)
+
+	// Missing source file
+	_, err = DownloadWithConfig(tmpFile, srcURL+".missing", config, NoResume)
+	fmt.Println("ERROR:", err)
+	require.True(t, errors.Is(err, os.ErrNotExist))
+
+	// The index.html files are not redirected to their directory
+	dir, err := os.MkdirTemp("", "downloader")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	index := filepath.Join(dir, "index.html")
+	require.NoError(t, os.WriteFile(index, []byte("<html></html>"), 0644))
+	indexURL := (&url.URL{Scheme: "file", Path: filepath.ToSlash(index)}).String()
+	if !strings.HasPrefix(indexURL, "file:///") {
+		indexURL = strings.Replace(indexURL, "file://", "file:///", 1)
+	}
+	require.NoError(t, Fetch(context.Background(), tmpFile, indexURL, config, NoResume))
+	data, err := os.ReadFile(tmpFile)
+	require.NoError(t, err)
+	require.Equal(t, "<html></html>", string(data))
+}
+
+func TestFileURLRedirect(t *testing.T) {
+	src, err := filepath.Abs("testdata/test.txt")
+	require.NoError(t, err)
+	srcURL := (&url.URL{Scheme: "file", Path: filepath.ToSlash(src)}).String()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, srcURL, http.StatusFound)
+	}))
+	defer server.Close()
+
+	for _, config := range []Config{{}, {AllowFileURLs: true}} {
+		out := &bytes.Buffer{}
+		_, err := DownloadToWriter(out, server.URL, config)
+		require.Error(t, err)
+		fmt.Println("ERROR:", err)
+		require.True(t, errors.Is(err, ErrFileRedirect))
+		require.Zero(t, out.Len())
+	}
+}
+
+func TestRampUp(t *testing.T) {
+	server := newSlowServer(t, 15, 0)
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	config := Config{MaxBytesPerSecond: 10000, RampUp: time.Second, BufferSize: 250}
+	d, err := DownloadWithConfig(tmpFile, server.URL, config)
+	require.NoError(t, err)
+	start := time.Now()
+	samples := []int64{}
+	require.NoError(t, d.RunAndPoll(func(current int64) {
+		if len(samples) < int(time.Since(start)/(500*time.Millisecond)) {
+			samples = append(samples, current)
+		}
+	}, 10*time.Millisecond))
+	require.True(t, time.Since(start) >= 1800*time.Millisecond, "completed in %s", time.Since(start))
+	require.True(t, len(samples) >= 3, "samples %v", samples)
+
+	// About 1250 bytes in the first half second, 5000 bytes between 1s and
+	// 1.5s at full speed
+	early := samples[0]
+	late := samples[2] - samples[1]
+	require.True(t, early < late/2, "early %d, late %d", early, late)
+}
+
+func TestAuthentication(t *testing.T) {
+	var authLock sync.Mutex
+	auths := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		authLock.Lock()
+		auths = append(auths, auth)
+		first := len(auths) == 1
+		authLock.Unlock()
+		if auth != "Bearer secret" && auth != "Basic dXNlcjpwYXNz" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if first {
+			// Force a retry
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		http.ServeFile(w, r, "testdata/test.txt")
+	}))
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	// Basic authentication, applied to the retry and to the resume
+	part, err := os.ReadFile("testdata/test.txt.part")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(tmpFile, part, 0644))
+	config := Config{
+		BasicAuth:  &BasicAuth{Username: "user", Password: "pass"},
+		MaxRetries: 1,
+		RetryDelay: time.Millisecond,
+	}
+	d, err := DownloadWithConfig(tmpFile, server.URL, config)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(part)), d.Completed())
+	require.NoError(t, d.Run())
+	requireSameAsTestFile(t, tmpFile)
+	require.Equal(t, []string{"Basic dXNlcjpwYXNz", "Basic dXNlcjpwYXNz"}, auths)
+
+	// The bearer token takes precedence
+	config.BearerToken = "secret"
+	require.NoError(t, Fetch(context.Background(), tmpFile, server.URL, config, NoResume))
+	require.Equal(t, "Bearer secret", auths[len(auths)-1])
+
+	_, err = Download(tmpFile, server.URL, NoResume)
+	var statusErr *HTTPStatusError
+	require.True(t, errors.As(err, &statusErr))
+	require.Equal(t, http.StatusUnauthorized, statusErr.Code)
+}
+
+type stubRoundTripper struct {
+	body     string
+	requests int32
+}
+
+func (s *stubRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&s.requests, 1)
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain"}},
+		Body:          io.NopCloser(strings.NewReader(s.body)),
+		ContentLength: int64(len(s.body)),
+		Request:       req,
+	}, nil
+}
+
+func TestStubTransport(t *testing.T) {
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	stub := &stubRoundTripper{body: "canned response"}
+	config := Config{
+		HttpClient: http.Client{Timeout: time.Minute},
+		Transport:  stub,
+	}
+	require.NoError(t, Fetch(context.Background(), tmpFile, "https://example.invalid/file.txt", config))
+	data, err := os.ReadFile(tmpFile)
+	require.NoError(t, err)
+	require.Equal(t, "canned response", string(data))
+	require.Equal(t, int32(1), atomic.LoadInt32(&stub.requests))
+}
+
+func TestNetworkBytes(t *testing.T) {
+	server := newTestFileServer(t)
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+	part, err := os.ReadFile("testdata/test.txt.part")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(tmpFile, part, 0644))
+
+	d, err := Download(tmpFile, server.URL+"/test.txt")
+	require.NoError(t, err)
+	require.Equal(t, int64(0), d.NetworkBytes())
+	require.NoError(t, d.Run())
+	requireSameAsTestFile(t, tmpFile)
+	require.Equal(t, int64(8052), d.Completed())
+	require.Equal(t, int64(8052-len(part)), d.NetworkBytes())
+
+	// Already complete: nothing is transferred
+	d, err = Download(tmpFile, server.URL+"/test.txt")
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	require.Equal(t, int64(0), d.NetworkBytes())
+}
+
+// brokenProxy simulates a proxy that replaces the Content-Length of the
+// responses, keeping the original one in X-Original-Length.
+type brokenProxy struct{}
+
+func (brokenProxy) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Header.Set("X-Original-Length", resp.Header.Get("Content-Length"))
+	resp.Header.Set("Content-Length", "100")
+	resp.ContentLength = 100
+	return resp, nil
+}
+
+func TestHeaderRewriter(t *testing.T) {
+	server := newTestFileServer(t)
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	// The download doesn't match the announced size
+	err := Fetch(context.Background(), tmpFile, server.URL+"/test.txt", Config{Transport: brokenProxy{}})
+	fmt.Println("ERROR:", err)
+	require.Error(t, err)
+
+	config := Config{
+		Transport: brokenProxy{},
+		HeaderRewriter: func(h http.Header) {
+			h.Set("Content-Length", h.Get("X-Original-Length"))
+		},
+	}
+	d, err := DownloadWithConfig(tmpFile, server.URL+"/test.txt", config, NoResume)
+	require.NoError(t, err)
+	require.Equal(t, int64(8052), d.Size())
+	require.NoError(t, d.Run())
+	requireSameAsTestFile(t, tmpFile)
+}
+
+func TestTLSConfig(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "testdata/test.txt")
+	}))
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	// The certificate of the test server is not trusted by default
+	_, err := Download(tmpFile, server.URL)
+	fmt.Println("ERROR:", err)
+	require.Error(t, err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	config := Config{TLSConfig: &tls.Config{RootCAs: roots}}
+	require.NoError(t, Fetch(context.Background(), tmpFile, server.URL, config, NoResume))
+	requireSameAsTestFile(t, tmpFile)
+
+	require.NoError(t, Fetch(context.Background(), tmpFile, server.URL, Config{InsecureSkipVerify: true}, NoResume))
+	requireSameAsTestFile(t, tmpFile)
+}
+
+// newSocks5Server starts a minimal SOCKS5 proxy, supporting only the CONNECT
+// command, that requires the given credentials if username is not empty.
+// It returns the address of the proxy and the number of connections served.
+func newSocks5Server(t *testing.T, username, password string) (string, *int32) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	var connections int32
+	handle := func(conn net.Conn) error {
+		defer conn.Close()
+		buf := make([]byte, 256)
+		// Greeting: VER NMETHODS METHODS
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+			return err
+		}
+		if username == "" {
+			_, err := conn.Write([]byte{5, 0})
+			if err != nil {
+				return err
+			}
+		} else {
+			if _, err := conn.Write([]byte{5, 2}); err != nil {
+				return err
+			}
+			// Username/password: VER ULEN UNAME PLEN PASSWD
+			if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+				return err
+			}
+			user := make([]byte, buf[1])
+			if _, err := io.ReadFull(conn, user); err != nil {
+				return err
+			}
+			if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+				return err
+			}
+			pass := make([]byte, buf[0])
+			if _, err := io.ReadFull(conn, pass); err != nil {
+				return err
+			}
+			if string(user) != username || string(pass) != password {
+				_, _ = conn.Write([]byte{1, 1})
+				return errors.New("bad credentials")
+			}
+			if _, err := conn.Write([]byte{1, 0}); err != nil {
+				return err
+			}
+		}
+		// Request: VER CMD RSV ATYP DST.ADDR DST.PORT
+		if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+			return err
+		}
+		var host string
+		switch buf[3] {
+		case 1:
+			if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+				return err
+			}
+			host = net.IP(buf[:4]).String()
+		case 3:
+			if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+				return err
+			}
+			name := make([]byte, buf[0])
+			if _, err := io.ReadFull(conn, name); err != nil {
+				return err
+			}
+			host = string(name)
+		default:
+			return errors.New("unsupported address type")
+		}
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return err
+		}
+		port := int(buf[0])<<8 | int(buf[1])
+		target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			_, _ = conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+			return err
+		}
+		defer target.Close()
+		if _, err := conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+			return err
+		}
+		atomic.AddInt32(&connections, 1)
+		go func() { _, _ = io.Copy(target, conn) }()
+		_, err = io.Copy(conn, target)
+		return err
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _ = handle(conn) }()
+		}
+	}()
+	return l.Addr().String(), &connections
+}
+
+func TestProxyURL(t *testing.T) {
+	server := newTestFileServer(t)
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	t.Run("SOCKS5", func(t *testing.T) {
+		addr, connections := newSocks5Server(t, "user", "pass")
+		proxyURL := &url.URL{Scheme: "socks5", Host: addr, User: url.UserPassword("user", "pass")}
+		require.NoError(t, Fetch(context.Background(), tmpFile, server.URL+"/test.txt", Config{ProxyURL: proxyURL}, NoResume))
+		requireSameAsTestFile(t, tmpFile)
+		require.Equal(t, int32(1), atomic.LoadInt32(connections))
+
+		proxyURL.User = url.UserPassword("user", "wrong")
+		_, err := DownloadWithConfig(tmpFile, server.URL+"/test.txt", Config{ProxyURL: proxyURL}, NoResume)
+		fmt.Println("ERROR:", err)
+		require.Error(t, err)
+	})
+	t.Run("HTTP", func(t *testing.T) {
+		var proxied int32
+		proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&proxied, 1)
+			resp, err := http.DefaultTransport.RoundTrip(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			defer resp.Body.Close()
+			for k, v := range resp.Header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(resp.StatusCode)
+			_, _ = io.Copy(w, resp.Body)
+		}))
+		defer proxy.Close()
+		proxyURL, err := url.Parse(proxy.URL)
+		require.NoError(t, err)
+		require.NoError(t, Fetch(context.Background(), tmpFile, server.URL+"/test.txt", Config{ProxyURL: proxyURL}, NoResume))
+		requireSameAsTestFile(t, tmpFile)
+		require.Equal(t, int32(1), atomic.LoadInt32(&proxied))
+	})
+}
+
+func TestAllowInsecureFallback(t *testing.T) {
+	// A plain HTTP server: the TLS handshake fails
+	server := newTestFileServer(t)
+	defer server.Close()
+	httpsURL := strings.Replace(server.URL, "http://", "https://", 1) + "/test.txt"
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	_, err := Download(tmpFile, httpsURL)
+	fmt.Println("ERROR:", err)
+	require.Error(t, err)
+
+	logs := &syncBuffer{}
+	config := Config{
+		AllowInsecureFallback: true,
+		Logger:                slog.New(slog.NewTextHandler(logs, nil)),
+	}
+	d, err := DownloadWithConfig(tmpFile, httpsURL, config)
+	require.NoError(t, err)
+	warnings := d.Warnings()
+	require.NoError(t, d.Run())
+	requireSameAsTestFile(t, tmpFile)
+	require.Equal(t, server.URL+"/test.txt", d.FinalURL())
+	require.Contains(t, logs.String(), "falling back to plain HTTP")
+	warning, ok := <-warnings
+	require.True(t, ok)
+	require.Contains(t, warning.Error(), "falling back to plain HTTP")
+}
+
+func TestEstimateTotalSize(t *testing.T) {
+	var active, maxActive int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&active, 1)
+		defer atomic.AddInt32(&active, -1)
+		for {
+			m := atomic.LoadInt32(&maxActive)
+			if n <= m || atomic.CompareAndSwapInt32(&maxActive, m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		switch {
+		case r.Method != "HEAD":
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		case strings.HasPrefix(r.URL.Path, "/known"):
+			w.Header().Set("Content-Length", "1000")
+		case strings.HasPrefix(r.URL.Path, "/unknown"):
+			// Chunked response: the size is unknown
+			w.Header().Set("Transfer-Encoding", "chunked")
+			w.(http.Flusher).Flush()
+		case r.URL.Path == "/nohead":
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	urls := []string{}
+	for i := 0; i < 15; i++ {
+		urls = append(urls, fmt.Sprintf("%s/known%d", server.URL, i))
+	}
+	for i := 0; i < 5; i++ {
+		urls = append(urls, fmt.Sprintf("%s/unknown%d", server.URL, i))
+	}
+	total, unknown, err := EstimateTotalSize(context.Background(), urls, Config{})
+	require.NoError(t, err)
+	require.Equal(t, int64(15000), total)
+	require.Equal(t, 5, unknown)
+	require.True(t, atomic.LoadInt32(&maxActive) <= estimateConcurrency, "%d concurrent requests", maxActive)
+
+	// Servers not supporting HEAD requests report an unknown size, the error
+	// statuses are returned
+	total, unknown, err = EstimateTotalSize(context.Background(), append(urls, server.URL+"/nohead", server.URL+"/missing"), Config{})
+	require.Error(t, err)
+	fmt.Println("ERROR:", err)
+	var statusErr *HTTPStatusError
+	require.True(t, errors.As(err, &statusErr))
+	require.Equal(t, http.StatusNotFound, statusErr.Code)
+	require.Equal(t, int64(15000), total)
+	require.Equal(t, 6, unknown)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err = EstimateTotalSize(ctx, urls, Config{})
+	require.True(t, errors.Is(err, context.Canceled))
+}
+
+func TestCookies(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "secret", Path: "/"})
+			http.Redirect(w, r, "/test.txt", http.StatusFound)
+		case "/test.txt":
+			if c, err := r.Cookie("session"); err != nil || c.Value != "secret" {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			http.ServeFile(w, r, "testdata/test.txt")
+		}
+	}))
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	// Without a jar the cookie set on the redirect is lost
+	_, err := Download(tmpFile, server.URL+"/login")
+	var statusErr *HTTPStatusError
+	require.True(t, errors.As(err, &statusErr))
+	require.Equal(t, http.StatusForbidden, statusErr.Code)
+
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	require.NoError(t, Fetch(context.Background(), tmpFile, server.URL+"/login", Config{CookieJar: jar}))
+	requireSameAsTestFile(t, tmpFile)
+
+	config := Config{Cookies: []*http.Cookie{{Name: "session", Value: "secret"}}}
+	require.NoError(t, Fetch(context.Background(), tmpFile, server.URL+"/test.txt", config, NoResume))
+	requireSameAsTestFile(t, tmpFile)
+}
+
+func TestMaxRedirects(t *testing.T) {
+	fileServer := newTestFileServer(t)
+	defer fileServer.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// /redirect/N redirects N more times before reaching the file
+		n, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/redirect/"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if n == 0 {
+			http.ServeFile(w, r, "testdata/test.txt")
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/redirect/%d", n-1), http.StatusFound)
+	}))
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	config := Config{MaxRedirects: 3, MaxRetries: 2, RetryDelay: time.Millisecond}
+	require.NoError(t, Fetch(context.Background(), tmpFile, server.URL+"/redirect/3", config))
+	requireSameAsTestFile(t, tmpFile)
+
+	_, err := DownloadWithConfig(tmpFile, server.URL+"/redirect/4", config, NoResume)
+	fmt.Println("ERROR:", err)
+	var redirectsErr *TooManyRedirectsError
+	require.True(t, errors.As(err, &redirectsErr))
+	require.Equal(t, 3, redirectsErr.Limit)
+
+	// The default limit of the http.Client
+	_, err = Download(tmpFile, server.URL+"/redirect/20", NoResume)
+	require.Error(t, err)
+
+	// Cross-host redirects
+	crossHost := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, strings.Replace(fileServer.URL, "127.0.0.1", "localhost", 1)+"/test.txt", http.StatusFound)
+	}))
+	defer crossHost.Close()
+	_, err = DownloadWithConfig(tmpFile, crossHost.URL, Config{AllowedRedirectHosts: []string{}}, NoResume)
+	fmt.Println("ERROR:", err)
+	require.True(t, errors.Is(err, ErrHostNotAllowed))
+	require.NoError(t, Fetch(context.Background(), tmpFile, crossHost.URL, Config{AllowedRedirectHosts: []string{"localhost"}}, NoResume))
+	requireSameAsTestFile(t, tmpFile)
+}
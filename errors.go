@@ -0,0 +1,112 @@
+//
+// Copyright 2018 Cristian Maglie. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package downloader
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrPrefixMismatch is returned when the downloaded content doesn't start
+// with Config.ExpectedPrefix.
+var ErrPrefixMismatch = errors.New("downloaded content doesn't match the expected prefix")
+
+// ErrWriteVerificationFailed is returned when the data read back from the
+// output file doesn't match the data written (see Config.VerifyWrites).
+var ErrWriteVerificationFailed = errors.New("written data verification failed")
+
+// ErrDecompressionLimitExceeded is returned when the decompressed content
+// exceeds Config.MaxDecompressedSize.
+var ErrDecompressionLimitExceeded = errors.New("decompressed content exceeds the size limit")
+
+// ErrRedirectChanged is returned when the redirects of the preflight request
+// and of the download lead to different urls (see
+// Config.StrictRedirectConsistency).
+var ErrRedirectChanged = errors.New("redirect target changed during the download")
+
+// HTTPStatusError is returned when the server replies with an error status
+// code (4xx or 5xx).
+type HTTPStatusError struct {
+	Code   int
+	Status string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("server replied %s", e.Status)
+}
+
+// ErrRangeNotSupported is returned when a range request is answered with the
+// whole content, because the server doesn't support range requests.
+var ErrRangeNotSupported = errors.New("server doesn't support range requests")
+
+// ErrHostNotAllowed is returned when a request, or a redirect, is directed
+// to a host not listed in Config.AllowedHosts.
+var ErrHostNotAllowed = errors.New("host not allowed")
+
+// ErrFileRedirect is returned when a server redirects a request to a url
+// with the "file" scheme. Local files are served only if requested directly
+// (see Config.AllowFileURLs).
+var ErrFileRedirect = errors.New("redirect to a file url not allowed")
+
+// ErrETAExceeded is returned when the estimated time to complete the
+// download exceeds Config.MaxETA. The partial download is kept and may be
+// resumed later.
+var ErrETAExceeded = errors.New("estimated time to complete the download exceeds the limit")
+
+// ShortDownloadError is returned when the connection is closed before
+// receiving all the bytes announced by the server.
+type ShortDownloadError struct {
+	Expected int64
+	Got      int64
+}
+
+func (e *ShortDownloadError) Error() string {
+	return fmt.Sprintf("download incomplete: expected %d bytes, got %d", e.Expected, e.Got)
+}
+
+// ErrUnexpectedSymlink is returned when the destination of a download is a
+// symbolic link and Config.NoFollowSymlinks is set.
+var ErrUnexpectedSymlink = errors.New("destination is a symbolic link")
+
+// InsufficientSpaceError is returned when the filesystem of the destination
+// hasn't enough free space for the download (see Config.CheckFreeSpace).
+type InsufficientSpaceError struct {
+	Required  int64
+	Available int64
+}
+
+func (e *InsufficientSpaceError) Error() string {
+	return fmt.Sprintf("insufficient free space: %d bytes required, %d available", e.Required, e.Available)
+}
+
+// MaxSizeExceededError is returned when the download is larger than
+// Config.MaxSize.
+type MaxSizeExceededError struct {
+	Limit int64
+}
+
+func (e *MaxSizeExceededError) Error() string {
+	return fmt.Sprintf("download exceeds the maximum size of %d bytes", e.Limit)
+}
+
+// ErrQuotaExceeded is returned when the downloads of a Manager exceed the
+// quota set with Manager.SetQuota.
+var ErrQuotaExceeded = errors.New("download quota exceeded")
+
+// ErrCertPinMismatch is returned when none of the certificates of the server
+// matches Config.PinnedCertSHA256.
+var ErrCertPinMismatch = errors.New("server certificate doesn't match the pinned certificates")
+
+// TooManyRedirectsError is returned when a download is redirected more than
+// Limit times (see Config.MaxRedirects).
+type TooManyRedirectsError struct {
+	Limit int
+}
+
+func (e *TooManyRedirectsError) Error() string {
+	return fmt.Sprintf("stopped after %d redirects", e.Limit)
+}
@@ -0,0 +1,66 @@
+//
+// Copyright 2018 Cristian Maglie. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// estimateConcurrency is the maximum number of concurrent HEAD requests
+// sent by EstimateTotalSize.
+const estimateConcurrency = 8
+
+// EstimateTotalSize returns the sum of the sizes of the files at the given
+// urls, obtained with concurrent HEAD requests, and the number of files
+// whose size is unknown (because the server doesn't report it, or doesn't
+// support HEAD requests). The errors of the failed requests, including the
+// error statuses as *HTTPStatusError, are joined together in the returned
+// error; the sizes of the other files are summed anyway.
+func EstimateTotalSize(ctx context.Context, urls []string, config Config) (int64, int, error) {
+	client := config.httpClient()
+	if config.ownsTransport() {
+		defer client.CloseIdleConnections()
+	}
+
+	var lock sync.Mutex
+	var total int64
+	var unknown int
+	var errs []error
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, estimateConcurrency)
+	for _, reqURL := range urls {
+		wg.Add(1)
+		go func(reqURL string) {
+			defer wg.Done()
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-ctx.Done():
+				lock.Lock()
+				errs = append(errs, fmt.Errorf("estimating size of %s: %w", reqURL, ctx.Err()))
+				lock.Unlock()
+				return
+			}
+			size, _, err := remoteSize(ctx, client, reqURL, config)
+			lock.Lock()
+			defer lock.Unlock()
+			switch {
+			case err != nil:
+				errs = append(errs, fmt.Errorf("estimating size of %s: %w", reqURL, err))
+			case size < 0:
+				unknown++
+			default:
+				total += size
+			}
+		}(reqURL)
+	}
+	wg.Wait()
+	return total, unknown, errors.Join(errs...)
+}
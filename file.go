@@ -0,0 +1,135 @@
+//
+// Copyright 2018 Cristian Maglie. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package downloader
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// fileTransport serves the file:// urls from the local filesystem, with
+// the same semantic of an HTTP server (ranges, Last-Modified, ...), and
+// forwards all the other requests to next. A file:// url is served only if
+// it's the url originally requested, never as the target of a redirect.
+type fileTransport struct {
+	next http.RoundTripper
+}
+
+func (t *fileTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "file" {
+		return t.nextTransport().RoundTrip(req)
+	}
+	if req.Response != nil {
+		return nil, fmt.Errorf("%w: %s", ErrFileRedirect, req.URL)
+	}
+	path := localPath(req.URL)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+	if info.IsDir() {
+		_ = f.Close()
+		return nil, fmt.Errorf("opening %s: is a directory", path)
+	}
+
+	// The file is served with http.ServeContent, instead of a FileServer,
+	// to avoid its handling of directories and index.html files
+	pr, pw := io.Pipe()
+	w := &fileResponseWriter{req: req, header: http.Header{}, body: pr, pw: pw, resp: make(chan *http.Response, 1)}
+	go func() {
+		defer f.Close()
+		http.ServeContent(w, req, filepath.Base(path), info.ModTime(), f)
+		w.WriteHeader(http.StatusOK)
+		_ = pw.Close()
+	}()
+	return <-w.resp, nil
+}
+
+// fileResponseWriter is the http.ResponseWriter used to serve a local file:
+// the response is sent on resp as soon as the headers are written, and the
+// body is streamed through a pipe.
+type fileResponseWriter struct {
+	req    *http.Request
+	header http.Header
+	body   *io.PipeReader
+	pw     *io.PipeWriter
+	resp   chan *http.Response
+	sent   bool
+}
+
+func (w *fileResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *fileResponseWriter) WriteHeader(code int) {
+	if w.sent {
+		return
+	}
+	w.sent = true
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode:    code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        w.header.Clone(),
+		Body:          w.body,
+		ContentLength: -1,
+		Request:       w.req,
+	}
+	if length, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64); err == nil {
+		resp.ContentLength = length
+	}
+	w.resp <- resp
+}
+
+func (w *fileResponseWriter) Write(data []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.pw.Write(data)
+}
+
+// CloseIdleConnections closes the idle connections of the next transport.
+func (t *fileTransport) CloseIdleConnections() {
+	if c, ok := t.nextTransport().(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+func (t *fileTransport) nextTransport() http.RoundTripper {
+	if t.next == nil {
+		return http.DefaultTransport
+	}
+	return t.next
+}
+
+// localPath returns the path of the local file of a file:// url.
+func localPath(u *url.URL) string {
+	path := u.Path
+	if runtime.GOOS == "windows" {
+		// file:///C:/dir/file
+		if len(path) > 2 && path[0] == '/' && path[2] == ':' {
+			path = path[1:]
+		}
+		if u.Host != "" && u.Host != "localhost" {
+			// UNC path: file://server/share/file
+			path = `\\` + u.Host + path
+		}
+	}
+	return filepath.FromSlash(strings.TrimSuffix(path, "/"))
+}
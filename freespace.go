@@ -0,0 +1,34 @@
+//
+// Copyright 2018 Cristian Maglie. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package downloader
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// freeSpace returns the space available to the user on the filesystem
+// containing dir, or -1 if it can't be determined on this platform. It's a
+// variable to allow the tests to simulate a full disk.
+var freeSpace = diskFreeSpace
+
+// checkFreeSpace returns an InsufficientSpaceError if Config.CheckFreeSpace
+// is set and the filesystem of file hasn't room for required more bytes. If
+// required or the free space are unknown the check is skipped.
+func (c *Config) checkFreeSpace(file string, required int64) error {
+	if !c.CheckFreeSpace || required < 0 {
+		return nil
+	}
+	available, err := freeSpace(filepath.Dir(file))
+	if err != nil {
+		return fmt.Errorf("checking free space for %s: %s", file, err)
+	}
+	if available >= 0 && available < required {
+		return &InsufficientSpaceError{Required: required, Available: available}
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+//
+// Copyright 2018 Cristian Maglie. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package downloader
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+)
+
+// Manager runs many downloads concurrently. Concurrent requests to download
+// the same url into the same file are deduplicated: they share a single
+// Downloader.
+type Manager struct {
+	ctx    context.Context
+	config Config
+
+	lock       sync.Mutex
+	inProgress map[string]*managedDownload
+	running    map[*Downloader]struct{}
+	wg         sync.WaitGroup
+	errs       []error
+
+	// quota is the maximum number of bytes downloaded in the session (see
+	// SetQuota), used is the number of bytes downloaded so far
+	quota         int64
+	used          int64
+	quotaExceeded bool
+}
+
+type managedDownload struct {
+	ready chan struct{}
+	d     *Downloader
+	err   error
+}
+
+// NewManager creates a Manager that performs the downloads with the given
+// configuration.
+func NewManager(config Config) *Manager {
+	return NewManagerWithContext(context.Background(), config)
+}
+
+// NewManagerWithContext creates a Manager that performs the downloads with
+// the given configuration. The downloads can be cancelled using the provided
+// context.
+func NewManagerWithContext(ctx context.Context, config Config) *Manager {
+	return &Manager{
+		ctx:        ctx,
+		config:     config,
+		inProgress: map[string]*managedDownload{},
+		running:    map[*Downloader]struct{}{},
+	}
+}
+
+// SetQuota limits the total bytes downloaded by all the downloads of the
+// Manager. Once the quota is reached the running downloads are canceled,
+// keeping the partial files so that they can be resumed later, Add fails
+// with ErrQuotaExceeded and Wait returns ErrQuotaExceeded. A quota of 0
+// means no limit.
+func (m *Manager) SetQuota(totalBytes int64) {
+	m.lock.Lock()
+	m.quota = totalBytes
+	m.lock.Unlock()
+	m.checkQuota(0)
+}
+
+// checkQuota accounts the bytes downloaded and, if the quota is exceeded,
+// stops all the running downloads.
+func (m *Manager) checkQuota(downloaded int64) {
+	m.lock.Lock()
+	m.used += downloaded
+	if m.quota <= 0 || m.used < m.quota || m.quotaExceeded {
+		m.lock.Unlock()
+		return
+	}
+	m.quotaExceeded = true
+	running := []*Downloader{}
+	for d := range m.running {
+		running = append(running, d)
+	}
+	m.lock.Unlock()
+	for _, d := range running {
+		d.Cancel()
+	}
+}
+
+// Add starts downloading the specified url in the specified file, and
+// returns the Downloader (already running). If a download of the same url
+// into the same file is already in progress, no new download is started and
+// the existing Downloader is returned (or the error that occurred while
+// starting it).
+func (m *Manager) Add(file string, reqURL string, options ...DownloadOptions) (*Downloader, error) {
+	return m.AddWithConfig(file, reqURL, m.config, options...)
+}
+
+// AddWithConfig is like Add, but the download is performed with the given
+// configuration instead of the one of the Manager.
+func (m *Manager) AddWithConfig(file string, reqURL string, config Config, options ...DownloadOptions) (*Downloader, error) {
+	key := reqURL + "\x00" + file
+	if abs, err := filepath.Abs(file); err == nil {
+		key = reqURL + "\x00" + abs
+	}
+
+	m.lock.Lock()
+	if m.quotaExceeded {
+		m.lock.Unlock()
+		return nil, ErrQuotaExceeded
+	}
+	if md, ok := m.inProgress[key]; ok {
+		m.lock.Unlock()
+		<-md.ready
+		return md.d, md.err
+	}
+	md := &managedDownload{ready: make(chan struct{})}
+	m.inProgress[key] = md
+	m.lock.Unlock()
+
+	d, err := DownloadWithConfigAndContext(m.ctx, file, reqURL, config, options...)
+	var progress <-chan int64
+	m.lock.Lock()
+	if err == nil && m.quotaExceeded {
+		// The quota has been exceeded while starting the download, after
+		// the running downloads have been stopped
+		_ = d.Close()
+		d, err = nil, ErrQuotaExceeded
+	}
+	if err == nil {
+		progress = d.Subscribe(0)
+		m.running[d] = struct{}{}
+	}
+	md.d, md.err = d, err
+	m.lock.Unlock()
+	close(md.ready)
+	if err != nil {
+		m.remove(key)
+		return nil, err
+	}
+
+	m.wg.Add(2)
+	go func() {
+		defer m.wg.Done()
+		prev := d.Completed()
+		for completed := range progress {
+			m.checkQuota(completed - prev)
+			prev = completed
+		}
+	}()
+	go func() {
+		defer m.wg.Done()
+		err := d.Run()
+		m.remove(key)
+		m.lock.Lock()
+		delete(m.running, d)
+		stoppedByQuota := m.quotaExceeded && errors.Is(err, context.Canceled)
+		if err != nil && !stoppedByQuota {
+			m.errs = append(m.errs, err)
+		}
+		m.lock.Unlock()
+	}()
+	return d, nil
+}
+
+func (m *Manager) remove(key string) {
+	m.lock.Lock()
+	delete(m.inProgress, key)
+	m.lock.Unlock()
+}
+
+// Wait waits for all the downloads to complete, and returns the errors of
+// the failed downloads (joined together) or nil if all the downloads
+// succeeded. If the quota has been exceeded the returned error matches
+// ErrQuotaExceeded.
+func (m *Manager) Wait() error {
+	m.wg.Wait()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.quotaExceeded {
+		return errors.Join(append([]error{ErrQuotaExceeded}, m.errs...)...)
+	}
+	return errors.Join(m.errs...)
+}
@@ -0,0 +1,162 @@
+//
+// Copyright 2018 Cristian Maglie. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestManagerDeduplicatesDownloads(t *testing.T) {
+	data, err := os.ReadFile("testdata/test.txt")
+	require.NoError(t, err)
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		time.Sleep(100 * time.Millisecond)
+		_, _ = w.Write(data)
+	}))
+	defer server.Close()
+	tmpFile := makeTmpFile(t)
+	defer os.Remove(tmpFile)
+
+	m := NewManager(Config{})
+	downloaders := make([]*Downloader, 10)
+	var wg sync.WaitGroup
+	for i := range downloaders {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			d, err := m.Add(tmpFile, server.URL, NoResume)
+			require.NoError(t, err)
+			downloaders[i] = d
+		}(i)
+	}
+	wg.Wait()
+	require.NoError(t, m.Wait())
+
+	require.Equal(t, int32(1), atomic.LoadInt32(&requests))
+	for _, d := range downloaders {
+		require.True(t, d == downloaders[0])
+	}
+	require.Equal(t, int64(8052), downloaders[0].Completed())
+	requireSameAsTestFile(t, tmpFile)
+
+	// Once completed, a new download can be started
+	_, err = m.Add(tmpFile, server.URL, NoResume)
+	require.NoError(t, err)
+	require.NoError(t, m.Wait())
+	require.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
+
+func TestDownloadManifest(t *testing.T) {
+	server := newTestFileServer(t)
+	dir, err := os.MkdirTemp("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	manifest := []ManifestEntry{
+		{URL: server.URL + "/test.txt", Path: filepath.Join(dir, "a.txt"), Checksum: testFileSHA256},
+		{URL: server.URL + "/test.txt?bad", Path: filepath.Join(dir, "b.txt"), Checksum: "sha256:0000"},
+		{URL: server.URL + "/test.txt", Path: filepath.Join(dir, "c.txt")},
+	}
+	err = DownloadManifest(context.Background(), manifest, Config{})
+	require.Error(t, err)
+	fmt.Println("ERROR:", err)
+	require.Contains(t, err.Error(), server.URL+"/test.txt?bad")
+	var mismatch *ChecksumMismatchError
+	require.True(t, errors.As(err, &mismatch))
+	require.Equal(t, "sha256:0000", mismatch.Expected)
+
+	requireSameAsTestFile(t, filepath.Join(dir, "a.txt"))
+	requireSameAsTestFile(t, filepath.Join(dir, "c.txt"))
+}
+
+func TestManagerQuota(t *testing.T) {
+	server := newSlowServer(t, 20, 50*time.Millisecond)
+	dir, err := os.MkdirTemp("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	m := NewManager(Config{})
+	m.SetQuota(5000)
+	files := []string{filepath.Join(dir, "a"), filepath.Join(dir, "b")}
+	for _, file := range files {
+		_, err := m.Add(file, server.URL)
+		require.NoError(t, err)
+	}
+	start := time.Now()
+	err = m.Wait()
+	fmt.Println("ERROR:", err)
+	require.True(t, errors.Is(err, ErrQuotaExceeded))
+	require.True(t, time.Since(start) < time.Second, "downloads not stopped")
+
+	// The partial files are kept to be resumed later
+	total := int64(0)
+	for _, file := range files {
+		info, err := os.Stat(file)
+		require.NoError(t, err)
+		require.True(t, info.Size() < 20000)
+		total += info.Size()
+	}
+	require.True(t, total >= 5000, "downloaded %d bytes", total)
+
+	_, err = m.Add(filepath.Join(dir, "c"), server.URL)
+	require.Equal(t, ErrQuotaExceeded, err)
+	_, err = os.Stat(filepath.Join(dir, "c"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestManagerQuotaConcurrentAdd(t *testing.T) {
+	slow := newSlowServer(t, 20, 50*time.Millisecond)
+	release := make(chan struct{})
+	blocked := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		http.ServeFile(w, r, "testdata/test.txt")
+	}))
+	defer blocked.Close()
+	dir, err := os.MkdirTemp("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	m := NewManager(Config{})
+	m.SetQuota(5000)
+	added := make(chan error)
+	go func() {
+		_, err := m.Add(filepath.Join(dir, "b"), blocked.URL)
+		added <- err
+	}()
+	_, err = m.Add(filepath.Join(dir, "a"), slow.URL)
+	require.NoError(t, err)
+
+	// The quota is exceeded while the second download is being started
+	for exceeded := false; !exceeded; time.Sleep(10 * time.Millisecond) {
+		m.lock.Lock()
+		exceeded = m.quotaExceeded
+		m.lock.Unlock()
+	}
+	close(release)
+	require.Equal(t, ErrQuotaExceeded, <-added)
+	err = m.Wait()
+	fmt.Println("ERROR:", err)
+	require.True(t, errors.Is(err, ErrQuotaExceeded))
+	info, err := os.Stat(filepath.Join(dir, "b"))
+	if err == nil {
+		require.True(t, info.Size() < 8052)
+	}
+}
@@ -0,0 +1,56 @@
+//
+// Copyright 2018 Cristian Maglie. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ManifestEntry describes a file to download with DownloadManifest
+type ManifestEntry struct {
+	// URL is the url of the file to download
+	URL string `json:"url" yaml:"url"`
+	// Path is the destination file
+	Path string `json:"path" yaml:"path"`
+	// Checksum, if set, is the expected checksum of the file, in the form
+	// accepted by Config.ExpectedChecksum.
+	Checksum string `json:"checksum,omitempty" yaml:"checksum,omitempty"`
+}
+
+// DownloadManifest downloads concurrently all the entries of the manifest,
+// verifying the checksum of each entry, and waits for all the downloads to
+// complete. The errors of the failed entries are joined together in the
+// returned error.
+func DownloadManifest(ctx context.Context, manifest []ManifestEntry, config Config) error {
+	m := NewManagerWithContext(ctx, config)
+	var errs []error
+	downloaders := make([]*Downloader, len(manifest))
+	for i, entry := range manifest {
+		entryConfig := config
+		if entry.Checksum != "" {
+			entryConfig.ExpectedChecksum = entry.Checksum
+		}
+		d, err := m.AddWithConfig(entry.Path, entry.URL, entryConfig)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("downloading %s: %w", entry.URL, err))
+			continue
+		}
+		downloaders[i] = d
+	}
+	_ = m.Wait()
+	for i, d := range downloaders {
+		if d == nil {
+			continue
+		}
+		if err := d.Error(); err != nil {
+			errs = append(errs, fmt.Errorf("downloading %s: %w", manifest[i].URL, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,160 @@
+//
+// Copyright 2018 Cristian Maglie. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package downloader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// resumeMeta contains the validators of the remote file of a partial
+// download. It's saved in a sidecar file next to the partial download, and
+// sent in the If-Range header when the download is resumed, so that a
+// partial download of a different version of the remote file is discarded.
+// URL is the url originally requested (before following the redirects), a
+// partial download of another url is not resumed.
+type resumeMeta struct {
+	URL          string `json:"url,omitempty"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// metaPath returns the path of the sidecar file of the partial download.
+func metaPath(file string) string {
+	return file + ".meta"
+}
+
+// loadResumeMeta loads the sidecar file of the partial download, returning
+// nil if it doesn't exist or it's not valid.
+func loadResumeMeta(file string) *resumeMeta {
+	data, err := os.ReadFile(metaPath(file))
+	if err != nil {
+		return nil
+	}
+	var meta resumeMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil
+	}
+	return &meta
+}
+
+// saveResumeMeta saves the requested url and the validators of the response
+// in the sidecar file of the partial download.
+func saveResumeMeta(file string, reqURL string, resp *http.Response) error {
+	meta := resumeMeta{
+		URL:          reqURL,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(metaPath(file), data, 0644)
+}
+
+// removeResumeMeta removes the sidecar file of the partial download, if any.
+func removeResumeMeta(file string) error {
+	if err := os.Remove(metaPath(file)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ifRange returns the value of the If-Range header: the ETag if it's a
+// strong validator, otherwise the Last-Modified date.
+func (m *resumeMeta) ifRange() string {
+	if m.ETag != "" && !strings.HasPrefix(m.ETag, "W/") {
+		return m.ETag
+	}
+	return m.LastModified
+}
+
+// lastModifiedPath returns the path of the sidecar file containing the
+// Last-Modified date of a complete download (see Config.SkipIfUnmodified).
+func lastModifiedPath(file string) string {
+	return file + ".modified"
+}
+
+// loadLastModified returns the Last-Modified date saved for the complete
+// download, or an empty string if there is none.
+func loadLastModified(file string) string {
+	data, err := os.ReadFile(lastModifiedPath(file))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// saveLastModified saves the Last-Modified date of the complete download. If
+// the server didn't send it the sidecar file is removed.
+func saveLastModified(file string, lastModified string) error {
+	if lastModified == "" {
+		return removeLastModified(file)
+	}
+	return os.WriteFile(lastModifiedPath(file), []byte(lastModified), 0644)
+}
+
+func removeLastModified(file string) error {
+	if err := os.Remove(lastModifiedPath(file)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// partialPath returns the path of the partial download of file with the
+// given validator embedded in the name (see Config.ValidatorInFilename).
+func partialPath(file string, validator string) string {
+	if validator == "" {
+		return file + ".part"
+	}
+	sum := sha256.Sum256([]byte(validator))
+	return file + "." + hex.EncodeToString(sum[:8]) + ".part"
+}
+
+// removeStalePartials removes the partial downloads of file created by
+// partialPath, except keep. The other files are left untouched.
+func removeStalePartials(file string, keep string) {
+	entries, err := os.ReadDir(filepath.Dir(file))
+	if err != nil {
+		return
+	}
+	base := filepath.Base(file)
+	for _, entry := range entries {
+		if name := entry.Name(); isPartialName(name, base) {
+			if path := filepath.Join(filepath.Dir(file), name); path != keep {
+				_ = os.Remove(path)
+			}
+		}
+	}
+}
+
+// isPartialName returns true if name is "<base>.part" or
+// "<base>.<16 hex digits>.part", as returned by partialPath.
+func isPartialName(name string, base string) bool {
+	if name == base+".part" {
+		return true
+	}
+	if !strings.HasPrefix(name, base+".") || !strings.HasSuffix(name, ".part") {
+		return false
+	}
+	digest := strings.TrimSuffix(strings.TrimPrefix(name, base+"."), ".part")
+	if len(digest) != 16 {
+		return false
+	}
+	for _, c := range digest {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
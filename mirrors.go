@@ -0,0 +1,46 @@
+//
+// Copyright 2018 Cristian Maglie. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// DownloadFromMirrors returns an asynchronous downloader that will download
+// the file from the first working url of the given mirrors. The mirrors are
+// tried in order, moving to the next one on connection errors or if the
+// server replies with an error status. The returned Downloader is bound to
+// the chosen mirror. If all the mirrors fail, the returned error joins the
+// errors of each mirror.
+func DownloadFromMirrors(file string, urls []string, config Config) (*Downloader, error) {
+	return DownloadFromMirrorsWithContext(context.Background(), file, urls, config)
+}
+
+// DownloadFromMirrorsWithContext is like DownloadFromMirrors, but the
+// download can be cancelled using the provided context.
+func DownloadFromMirrorsWithContext(ctx context.Context, file string, urls []string, config Config) (*Downloader, error) {
+	if len(urls) == 0 {
+		return nil, errors.New("no mirrors to download from")
+	}
+	ctx = withWarnings(ctx)
+	errs := []error{}
+	for _, reqURL := range urls {
+		d, err := DownloadWithConfigAndContext(ctx, file, reqURL, config)
+		if err == nil {
+			return d, nil
+		}
+		err = fmt.Errorf("mirror %s: %w", reqURL, err)
+		reportWarning(ctx, err)
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
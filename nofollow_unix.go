@@ -0,0 +1,15 @@
+//
+// Copyright 2018 Cristian Maglie. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package downloader
+
+import "syscall"
+
+// oNoFollow is the flag that makes the opening of a symbolic link fail.
+const oNoFollow = syscall.O_NOFOLLOW
@@ -0,0 +1,704 @@
+//
+// Copyright 2018 Cristian Maglie. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// byteRange is a range of bytes, from Start to End (both included)
+type byteRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// segment is a byte range of a parallel download. The End and written
+// fields are protected by the lock of the parallelDownload, since the
+// segment may be split while it's being downloaded (see
+// Config.AdaptiveSegments).
+type segment struct {
+	byteRange
+	// resp is the response for the range, if already requested
+	resp *http.Response
+	// written is the number of bytes of the segment written so far
+	written int64
+	// reserved is the number of bytes received and being written, that
+	// can't be moved to another segment
+	reserved int64
+	// active is set while the segment is being downloaded
+	active bool
+}
+
+// parallelDownload is the state of a parallel download
+type parallelDownload struct {
+	connections int
+	segments    []*segment
+	// meta contains the ranges already completed by a previous run
+	meta segmentsMeta
+
+	lock sync.Mutex
+	// saveLock serializes the saves of the sidecar file
+	saveLock sync.Mutex
+	// pending are the segments not started yet (adaptive mode)
+	pending []*segment
+	// workers is the number of segments being downloaded, and target the
+	// number of connections to use (adaptive mode)
+	workers int
+	target  int
+}
+
+// SegmentProgress is the progress of a segment of a parallel download
+type SegmentProgress struct {
+	// Start and End are the first and the last byte of the segment
+	Start int64
+	End   int64
+	// Written is the number of bytes of the segment written so far
+	Written int64
+}
+
+// SegmentProgress returns the progress of the segments of a parallel
+// download (see DownloadParallel) being downloaded, one for each connection
+// in use. It returns nil if the download doesn't use many connections.
+func (d *Downloader) SegmentProgress() []SegmentProgress {
+	p := d.parallel
+	if p == nil {
+		return nil
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var res []SegmentProgress
+	for _, s := range p.segments {
+		if s.active {
+			res = append(res, SegmentProgress{Start: s.Start, End: s.End, Written: s.written})
+		}
+	}
+	return res
+}
+
+// remaining returns the range of the segment not written yet.
+func (p *parallelDownload) remaining(s *segment) byteRange {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return byteRange{Start: s.Start + s.written, End: s.End}
+}
+
+// reserve clamps the n bytes received for the segment to its current end,
+// that may have been moved while receiving them, and reserves them until
+// addWritten is called, so that they are not moved to another segment.
+func (p *parallelDownload) reserve(s *segment, n int) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if left := s.End - s.Start - s.written + 1; int64(n) > left {
+		n = int(left)
+	}
+	s.reserved = int64(n)
+	return n
+}
+
+// addWritten records that n more bytes of the segment, reserved with
+// reserve, have been written.
+func (p *parallelDownload) addWritten(s *segment, n int64) {
+	p.lock.Lock()
+	s.written += n
+	s.reserved = 0
+	p.lock.Unlock()
+}
+
+// setActive marks the segment as being downloaded, or not.
+func (p *parallelDownload) setActive(s *segment, active bool) {
+	p.lock.Lock()
+	s.active = active
+	p.lock.Unlock()
+}
+
+// nextSegment returns the next segment to download in adaptive mode: a
+// pending one or, if there are none, the second half of the active segment
+// with most bytes left. It returns nil if there is nothing left to split.
+// It must be called with the lock held.
+func (p *parallelDownload) nextSegment() *segment {
+	if len(p.pending) > 0 {
+		s := p.pending[0]
+		p.pending = p.pending[1:]
+		return s
+	}
+	var largest *segment
+	var largestSize int64
+	for _, s := range p.segments {
+		if size := s.End - s.Start - s.written - s.reserved + 1; s.active && size > largestSize {
+			largest, largestSize = s, size
+		}
+	}
+	if largest == nil || largestSize < 2*minSegmentSize {
+		return nil
+	}
+	end := largest.End
+	largest.End -= largestSize / 2
+	s := &segment{byteRange: byteRange{Start: largest.End + 1, End: end}}
+	p.segments = append(p.segments, s)
+	return s
+}
+
+// segmentsMeta is saved in a sidecar file next to an interrupted parallel
+// download, to resume it later. It's independent of the number of
+// connections.
+type segmentsMeta struct {
+	Size int64       `json:"size"`
+	ETag string      `json:"etag,omitempty"`
+	Done []byteRange `json:"done"`
+}
+
+// DownloadParallel returns an asynchronous downloader that will download the
+// specified url into the specified file using many connections at once. The
+// file is split in segments of the same size, each one downloaded with its
+// own range request. If the server doesn't support range requests, the
+// size of the file is unknown, or connections is less than 2, the file is
+// downloaded with a single connection.
+//
+// The ranges already completed are saved in a sidecar file
+// "<file>.segments", each time a segment is completed and when the download
+// is interrupted, so that a following DownloadParallel resumes the download
+// fetching only the missing ranges, even with a different number of
+// connections.
+//
+// If Config.AdaptiveSegments is set, connections is the maximum number of
+// connections used, and the number of connections is adjusted during the
+// download according to the transfer rate.
+func DownloadParallel(file string, reqURL string, connections int, config Config) (*Downloader, error) {
+	return DownloadParallelWithContext(context.Background(), file, reqURL, connections, config)
+}
+
+// DownloadParallelWithContext is like DownloadParallel, but the download can
+// be cancelled using the provided context.
+func DownloadParallelWithContext(ctx context.Context, file string, reqURL string, connections int, config Config) (*Downloader, error) {
+	ctx, cancel := context.WithCancel(withWarnings(ctx))
+	d, err := downloadParallel(ctx, file, reqURL, connections, config)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	d.cancel = cancel
+	return d, nil
+}
+
+func downloadParallel(ctx context.Context, file string, reqURL string, connections int, config Config) (*Downloader, error) {
+	if len(config.ExtraWriters) > 0 {
+		// The extra writers must receive the data in order
+		connections = 1
+	}
+	if err := config.checkSymlink(file); err != nil {
+		return nil, err
+	}
+	client := config.httpClient()
+	size, etag := int64(-1), ""
+	if connections > 1 {
+		var err error
+		if size, etag, err = remoteSize(ctx, client, reqURL, config); err != nil {
+			return nil, err
+		}
+	}
+	if connections <= 1 || size < int64(connections) {
+		_ = removeSegmentsMeta(file)
+		return download(ctx, file, reqURL, config, NoResume)
+	}
+
+	// Resume the ranges missing from a previous run, if the remote file
+	// didn't change
+	meta := segmentsMeta{Size: size, ETag: etag}
+	if prev := loadSegmentsMeta(file); prev != nil && prev.Size == size && prev.ETag == etag {
+		if _, err := os.Stat(file); err == nil {
+			meta.Done = prev.Done
+		}
+	}
+	segments := splitRanges(missingRanges(meta.Done, size), connections)
+	if len(segments) == 0 {
+		// Nothing left to download (the sidecar file is stale)
+		meta.Done = nil
+		segments = splitRanges(missingRanges(nil, size), connections)
+	}
+
+	resp, err := doRangeRequest(ctx, client, reqURL, config, segments[0].byteRange)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		// The server doesn't support range requests
+		_ = resp.Body.Close()
+		_ = removeSegmentsMeta(file)
+		return download(ctx, file, reqURL, config, NoResume)
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("requesting range of %s: %w", reqURL, rangeError(resp))
+	}
+	segments[0].resp = resp
+
+	remaining := size
+	for _, r := range meta.Done {
+		remaining -= r.End - r.Start + 1
+	}
+	if err := config.checkFreeSpace(file, remaining); err != nil {
+		_ = resp.Body.Close()
+		return nil, err
+	}
+	if err := config.checkMaxSize(size); err != nil {
+		_ = resp.Body.Close()
+		return nil, err
+	}
+
+	flags := os.O_RDWR | os.O_CREATE
+	if len(meta.Done) == 0 {
+		flags |= os.O_TRUNC
+	}
+	f, err := config.openFile(file, flags, len(meta.Done) > 0)
+	if err != nil {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("opening %s for writing: %s", file, err)
+	}
+	if _, ok := f.(io.WriterAt); !ok {
+		_ = f.Close()
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("opening %s for writing: parallel downloads require an io.WriterAt", file)
+	}
+
+	d := newDownloader(ctx, client, reqURL, config, resp, 0)
+	for _, r := range meta.Done {
+		d.completed += r.End - r.Start + 1
+	}
+	d.downloaded = d.completed
+	d.resumed = d.completed > 0
+	d.resumedBytes = d.completed
+	d.size = size
+	d.out = f
+	d.outCloser = f
+	d.path = file
+	d.parallel = &parallelDownload{connections: connections, segments: segments, meta: meta}
+	return d, nil
+}
+
+// remoteSize returns the size and the ETag of the remote file using a HEAD
+// request. The size is -1 if the server doesn't report it or doesn't support
+// HEAD requests (405 or 501 status codes). Any other error status is
+// returned as an *HTTPStatusError.
+func remoteSize(ctx context.Context, client *http.Client, reqURL string, config Config) (int64, string, error) {
+	resp, err := head(ctx, client, reqURL, config)
+	if err != nil {
+		return 0, "", err
+	}
+	if resp == nil || resp.StatusCode != http.StatusOK {
+		return -1, "", nil
+	}
+	return resp.ContentLength, resp.Header.Get("ETag"), nil
+}
+
+func doRangeRequest(ctx context.Context, client *http.Client, reqURL string, config Config, r byteRange) (*http.Response, error) {
+	req, err := newRequest(withRequestTiming(ctx), "GET", reqURL, config)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", r.Start, r.End))
+	return client.Do(req)
+}
+
+// missingRanges returns the ranges of a file of the given size not covered
+// by done.
+func missingRanges(done []byteRange, size int64) []byteRange {
+	missing := []byteRange{}
+	next := int64(0)
+	for _, r := range mergeRanges(done) {
+		if r.Start > next {
+			missing = append(missing, byteRange{Start: next, End: r.Start - 1})
+		}
+		next = r.End + 1
+	}
+	if next < size {
+		missing = append(missing, byteRange{Start: next, End: size - 1})
+	}
+	return missing
+}
+
+// mergeRanges sorts the ranges and merges the overlapping or adjacent ones.
+func mergeRanges(ranges []byteRange) []byteRange {
+	sorted := append([]byteRange{}, ranges...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start < sorted[j].Start })
+	merged := []byteRange{}
+	for _, r := range sorted {
+		if n := len(merged); n > 0 && r.Start <= merged[n-1].End+1 {
+			if r.End > merged[n-1].End {
+				merged[n-1].End = r.End
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// splitRanges splits the ranges into segments of about the same size, to be
+// downloaded with the given number of connections.
+func splitRanges(ranges []byteRange, connections int) []*segment {
+	total := int64(0)
+	for _, r := range ranges {
+		total += r.End - r.Start + 1
+	}
+	if total == 0 {
+		return nil
+	}
+	segmentSize := (total + int64(connections) - 1) / int64(connections)
+	segments := []*segment{}
+	for _, r := range ranges {
+		for start := r.Start; start <= r.End; start += segmentSize {
+			end := start + segmentSize - 1
+			if end > r.End {
+				end = r.End
+			}
+			segments = append(segments, &segment{byteRange: byteRange{Start: start, End: end}})
+		}
+	}
+	return segments
+}
+
+// copyParallel downloads all the segments concurrently. If a segment fails
+// the others are aborted, and the ranges completed are saved to resume the
+// download later.
+func (d *Downloader) copyParallel(rate RateEstimator) error {
+	var errOnce sync.Once
+	var firstErr error
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			d.cancel()
+		})
+	}
+	if d.config.AdaptiveSegments {
+		d.copyAdaptiveSegments(rate, fail)
+	} else {
+		d.copySegments(rate, fail)
+	}
+	if firstErr != nil {
+		d.saveSegments()
+		return firstErr
+	}
+	_ = removeSegmentsMeta(d.path)
+
+	// The data is not received in order: check the prefix and compute the
+	// digests from the assembled file.
+	f, err := os.Open(d.path)
+	if err != nil {
+		return fmt.Errorf("reading downloaded file: %s", err)
+	}
+	defer f.Close()
+	if prefix := d.config.ExpectedPrefix; len(prefix) > 0 {
+		head := make([]byte, len(prefix))
+		n, _ := io.ReadFull(f, head)
+		if !bytes.Equal(head[:n], prefix) {
+			return ErrPrefixMismatch
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("reading downloaded file: %s", err)
+		}
+	}
+	if len(d.hashes) > 0 {
+		if _, err := io.Copy(hashWriter{d}, f); err != nil {
+			return fmt.Errorf("hashing downloaded file: %s", err)
+		}
+	}
+	return nil
+}
+
+// copySegments downloads the segments with a fixed number of connections.
+func (d *Downloader) copySegments(rate RateEstimator, fail func(error)) {
+	p := d.parallel
+	var wg sync.WaitGroup
+	connections := make(chan struct{}, p.connections)
+	for _, s := range p.segments {
+		wg.Add(1)
+		go func(s *segment) {
+			defer wg.Done()
+			connections <- struct{}{}
+			defer func() { <-connections }()
+			p.setActive(s, true)
+			defer p.setActive(s, false)
+			if err := d.copySegment(s, rate); err != nil {
+				fail(err)
+			}
+		}(s)
+	}
+	wg.Wait()
+}
+
+// minSegmentSize is the minimum size of the segments created by splitting a
+// segment in adaptive mode.
+const minSegmentSize = 4096
+
+// adaptiveSegmentsInterval is the interval between the measures of the
+// transfer rate that decide if a new connection is opened in adaptive mode.
+var adaptiveSegmentsInterval = time.Second
+
+// adaptiveSegmentsGain is the minimum increase of the transfer rate, after
+// a new connection is opened, to try with another one.
+const adaptiveSegmentsGain = 1.2
+
+// copyAdaptiveSegments downloads the segments starting with a single
+// connection, and opens a new one, splitting the active segment with most
+// bytes left, every adaptiveSegmentsInterval as long as the transfer rate
+// improves, up to the configured number of connections. If a new connection
+// doesn't improve enough the transfer rate, the connections are reduced by
+// one and no more connections are added.
+func (d *Downloader) copyAdaptiveSegments(rate RateEstimator, fail func(error)) {
+	p := d.parallel
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+
+	var worker func(s *segment)
+	worker = func(s *segment) {
+		defer wg.Done()
+		for s != nil {
+			p.setActive(s, true)
+			err := d.copySegment(s, rate)
+			p.lock.Lock()
+			s.active = false
+			if err != nil || p.workers > p.target {
+				s = nil
+			} else {
+				s = p.nextSegment()
+				if s != nil {
+					s.active = true
+				}
+			}
+			if s == nil {
+				p.workers--
+				if p.workers == 0 {
+					close(done)
+				}
+			}
+			p.lock.Unlock()
+			if err != nil {
+				fail(err)
+			}
+		}
+	}
+	start := func() bool {
+		s := p.nextSegment()
+		if s == nil {
+			return false
+		}
+		s.active = true
+		p.workers++
+		wg.Add(1)
+		go worker(s)
+		return true
+	}
+
+	p.lock.Lock()
+	p.pending = p.segments
+	p.target = 1
+	started := start()
+	p.lock.Unlock()
+	if !started {
+		return
+	}
+
+	t := time.NewTicker(adaptiveSegmentsInterval)
+	defer t.Stop()
+	last, lastTime := d.Completed(), time.Now()
+	var prevSpeed float64
+	grown, frozen := false, false
+	for {
+		select {
+		case <-done:
+			wg.Wait()
+			return
+		case now := <-t.C:
+			completed := d.Completed()
+			speed := float64(completed-last) / now.Sub(lastTime).Seconds()
+			last, lastTime = completed, now
+			p.lock.Lock()
+			if grown && speed < prevSpeed*adaptiveSegmentsGain {
+				// The new connection didn't help: back off
+				p.target--
+				frozen = true
+			}
+			grown = false
+			if !frozen && p.target < p.connections && p.workers > 0 {
+				if start() {
+					p.target++
+					prevSpeed, grown = speed, true
+				}
+			}
+			p.lock.Unlock()
+		}
+	}
+}
+
+// copySegment downloads a segment. If the transfer fails because of a
+// network error or a temporary server error, the segment is retried from the
+// last byte written, up to Config.MaxRetries times, without affecting the
+// other segments.
+func (d *Downloader) copySegment(s *segment, rate RateEstimator) error {
+	for attempt := 1; ; attempt++ {
+		retryable, err := d.copySegmentOnce(s, rate)
+		if err == nil {
+			// The progress is not lost even if the process is killed
+			d.saveSegments()
+			return nil
+		}
+		if !retryable || attempt > d.config.MaxRetries || d.ctx.Err() != nil {
+			return err
+		}
+		end := d.parallel.remaining(s).End
+		d.config.logWarn("segment failed, retrying", "url", d.URL, "start", s.Start, "end", end, "attempt", attempt, "error", err)
+		reportWarning(d.ctx, fmt.Errorf("segment %d-%d of %s failed, retrying: %w", s.Start, end, d.URL, err))
+		if err := sleep(d.ctx, d.config.retryDelay(attempt)); err != nil {
+			return err
+		}
+	}
+}
+
+// copySegmentOnce downloads the part of the segment not written yet. The
+// returned bool is true if the error may be solved by retrying.
+func (d *Downloader) copySegmentOnce(s *segment, rate RateEstimator) (bool, error) {
+	resp := s.resp
+	s.resp = nil
+	if resp == nil {
+		var err error
+		resp, err = doRangeRequest(d.ctx, d.client, d.URL, d.config, d.parallel.remaining(s))
+		if err != nil {
+			return isRetryable(nil, err), err
+		}
+		if resp.StatusCode != http.StatusPartialContent {
+			_ = resp.Body.Close()
+			return isRetryable(resp, nil), fmt.Errorf("requesting range of %s: %w", d.URL, rangeError(resp))
+		}
+	}
+	defer resp.Body.Close()
+
+	out := d.out.(io.WriterAt)
+	buff := make([]byte, d.config.bufferSize())
+	for {
+		// The end of the segment may be moved while downloading it
+		r := d.parallel.remaining(s)
+		if r.Start > r.End {
+			break
+		}
+		offset := r.Start
+		if err := d.waitAllowedWindow(); err != nil {
+			return false, err
+		}
+		if err := d.waitResumed(); err != nil {
+			return false, err
+		}
+		n, err := resp.Body.Read(buff)
+		if n > 0 {
+			// The segment may have been split during the Read
+			n = d.parallel.reserve(s, n)
+		}
+		if n > 0 {
+			d.addProgress(int64(n), 0)
+			if _, err := out.WriteAt(buff[:n], offset); err != nil {
+				return false, fmt.Errorf("writing output: %w", err)
+			}
+			if d.config.VerifyWrites {
+				if err := d.verifyWrite(buff[:n], offset); err != nil {
+					return false, err
+				}
+			}
+			d.parallel.addWritten(s, int64(n))
+			completed := d.addProgress(0, int64(n))
+			rate.Observe(completed, time.Now())
+			d.notifySubscribers(completed)
+			if err := d.checkETA(); err != nil {
+				return false, err
+			}
+			if err := d.throttle.wait(d.ctx, n); err != nil {
+				return false, err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return true, err
+		}
+	}
+	if r := d.parallel.remaining(s); r.Start <= r.End {
+		return true, fmt.Errorf("segment %d-%d of %s: %w", s.Start, r.End, d.URL, io.ErrUnexpectedEOF)
+	}
+	return false, nil
+}
+
+// saveSegments saves the ranges completed so far in the sidecar file, after
+// flushing the output to disk, to resume the download later. The ranges are
+// collected before the flush, so that the bytes written meanwhile by the
+// other segments, that may not be on disk yet, are not recorded.
+func (d *Downloader) saveSegments() {
+	p := d.parallel
+	p.saveLock.Lock()
+	defer p.saveLock.Unlock()
+	p.lock.Lock()
+	meta := p.meta
+	meta.Done = append([]byteRange{}, p.meta.Done...)
+	for _, s := range p.segments {
+		if s.written > 0 {
+			meta.Done = append(meta.Done, byteRange{Start: s.Start, End: s.Start + s.written - 1})
+		}
+	}
+	p.lock.Unlock()
+	if f, ok := d.out.(interface{ Sync() error }); ok {
+		if err := f.Sync(); err != nil {
+			d.config.logWarn("saving completed ranges", "file", d.path, "error", err)
+			return
+		}
+	}
+	meta.Done = mergeRanges(meta.Done)
+	if err := saveSegmentsMeta(d.path, meta); err != nil {
+		d.config.logWarn("saving completed ranges", "file", d.path, "error", err)
+	}
+}
+
+// segmentsMetaPath returns the path of the sidecar file of the parallel
+// download.
+func segmentsMetaPath(file string) string {
+	return file + ".segments"
+}
+
+// loadSegmentsMeta loads the sidecar file of the parallel download,
+// returning nil if it doesn't exist or it's not valid.
+func loadSegmentsMeta(file string) *segmentsMeta {
+	data, err := os.ReadFile(segmentsMetaPath(file))
+	if err != nil {
+		return nil
+	}
+	var meta segmentsMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil
+	}
+	return &meta
+}
+
+func saveSegmentsMeta(file string, meta segmentsMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(segmentsMetaPath(file), data, 0644)
+}
+
+func removeSegmentsMeta(file string) error {
+	if err := os.Remove(segmentsMetaPath(file)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,361 @@
+//
+// Copyright 2018 Cristian Maglie. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package downloader
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Subscribe returns a channel that receives the bytes completed so far each
+// time the download progresses. The channel is closed when the download
+// ends.
+//
+// The channel has a buffer of bufferSize values (a bufferSize less than 1 is
+// treated as 1). The copy-loop never waits for a subscriber: if the buffer
+// is full when a new value must be sent, the oldest buffered value is
+// dropped to make room for the new one. This means that a slow subscriber
+// always receives the most recent progress, but may miss intermediate
+// values. With the default bufferSize of 0 only the latest value is kept
+// (coalescing). The memory used by each subscriber is bounded by its buffer
+// size.
+//
+// Subscribe should be called before the download is started, otherwise
+// some progress updates may be missed. If the download has already ended the
+// returned channel is closed.
+func (d *Downloader) Subscribe(bufferSize int) <-chan int64 {
+	if bufferSize < 1 {
+		bufferSize = 1
+	}
+	ch := make(chan int64, bufferSize)
+	d.subscribersLock.Lock()
+	defer d.subscribersLock.Unlock()
+	if d.subscribersClosed {
+		close(ch)
+		return ch
+	}
+	d.subscribers = append(d.subscribers, ch)
+	return ch
+}
+
+// notifySubscribers sends the current progress to all the subscribers,
+// dropping the oldest buffered value if a subscriber is lagging behind.
+func (d *Downloader) notifySubscribers(current int64) {
+	d.subscribersLock.Lock()
+	defer d.subscribersLock.Unlock()
+	for _, ch := range d.subscribers {
+		sendLatest(ch, current)
+	}
+}
+
+// sendLatest sends the value on ch without blocking, dropping the oldest
+// buffered value if the buffer is full.
+func sendLatest[T any](ch chan T, value T) {
+	select {
+	case ch <- value:
+		return
+	default:
+	}
+	// Buffer full: drop the oldest value and retry
+	select {
+	case <-ch:
+	default:
+	}
+	select {
+	case ch <- value:
+	default:
+	}
+}
+
+// ProgressChan returns a channel that receives the bytes completed so far
+// as the download progresses, at most once every Config.MinPollInterval,
+// and is closed when the download ends, after receiving the final value.
+// It's an alternative to RunAndPoll for the callers that already have a
+// select loop. Like Subscribe, the download never waits for the consumer:
+// a consumer that doesn't drain the channel only misses intermediate
+// values. ProgressChan should be called before the download is started.
+func (d *Downloader) ProgressChan() <-chan int64 {
+	interval := d.config.MinPollInterval
+	if interval <= 0 {
+		interval = defaultMinPollInterval
+	}
+	updates := d.Subscribe(1)
+	out := make(chan int64, 1)
+	go func() {
+		defer close(out)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		var last time.Time
+		var current int64
+		pending := false
+		for {
+			select {
+			case completed, ok := <-updates:
+				if !ok {
+					if pending {
+						sendLatest(out, current)
+					}
+					return
+				}
+				current, pending = completed, true
+			case <-t.C:
+			}
+			if pending && time.Since(last) >= interval {
+				sendLatest(out, current)
+				last, pending = time.Now(), false
+			}
+		}
+	}()
+	return out
+}
+
+// closeSubscribers closes all the subscribers channels.
+func (d *Downloader) closeSubscribers() {
+	d.subscribersLock.Lock()
+	defer d.subscribersLock.Unlock()
+	for _, ch := range d.subscribers {
+		close(ch)
+	}
+	d.subscribers = nil
+	d.subscribersClosed = true
+}
+
+// defaultMinPollInterval is the interval used by the built-in progress
+// reporters if Config.MinPollInterval is not set.
+const defaultMinPollInterval = 500 * time.Millisecond
+
+// startReporters starts the built-in progress reporters enabled in the
+// configuration. The returned function must be called at the end of the
+// download: it makes a final report and stops the reporters.
+func (d *Downloader) startReporters() func() {
+	var reporters []func(final bool)
+	if d.config.ProgressOutput != nil {
+		reporters = append(reporters, d.newStatusLineReporter(d.config.ProgressOutput))
+	}
+	if d.config.ProgressReporter != nil {
+		reporters = append(reporters, d.newSnapshotReporter(d.config.ProgressReporter))
+	}
+	if d.config.LogProgress && d.config.Logger != nil {
+		reporters = append(reporters, d.newLogReporter())
+	}
+	if d.config.ProgressJSONWriter != nil {
+		reporters = append(reporters, d.newJSONReporter(d.config.ProgressJSONWriter))
+	}
+	if len(reporters) == 0 {
+		return func() {}
+	}
+
+	interval := d.config.MinPollInterval
+	if interval <= 0 {
+		interval = defaultMinPollInterval
+	}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				for _, report := range reporters {
+					report(false)
+				}
+			case <-stop:
+				for _, report := range reporters {
+					report(true)
+				}
+				close(stopped)
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
+
+// ProgressSnapshot describes the progress of a download at a given time
+type ProgressSnapshot struct {
+	URL            string
+	Path           string
+	Completed      int64
+	Total          int64
+	BytesPerSecond float64
+	ETA            time.Duration
+}
+
+// Snapshot returns the current progress of the download
+func (d *Downloader) Snapshot() ProgressSnapshot {
+	completed, total := d.Progress()
+	return ProgressSnapshot{
+		URL:            d.URL,
+		Path:           d.path,
+		Completed:      completed,
+		Total:          total,
+		BytesPerSecond: d.BytesPerSecond(),
+		ETA:            d.ETA(),
+	}
+}
+
+// Progress describes the progress of a download as reported by
+// RunAndPollProgress
+type Progress struct {
+	Current int64
+	// Size is -1 if unknown
+	Size int64
+	// Speed is the transfer rate in bytes per second since the previous
+	// report
+	Speed float64
+	// ETA is 0 if unknown
+	ETA time.Duration
+	// Percent is -1 if the size is unknown
+	Percent float64
+}
+
+// RunAndPollProgress is like RunAndPoll, but the poll function receives
+// also the transfer speed and the estimated time to complete the download.
+func (d *Downloader) RunAndPollProgress(poll func(progress Progress), interval time.Duration) error {
+	prev, prevTime := d.Completed(), time.Now()
+	speed := 0.0
+	return d.RunAndPoll(func(int64) {
+		now := time.Now()
+		current, size := d.Progress()
+		if elapsed := now.Sub(prevTime); elapsed > 0 {
+			speed = float64(current-prev) / elapsed.Seconds()
+		}
+		prev, prevTime = current, now
+
+		p := Progress{Current: current, Size: size, Speed: speed, Percent: -1}
+		if size > 0 {
+			p.Percent = float64(current) * 100 / float64(size)
+			if speed > 0 && current < size {
+				p.ETA = time.Duration(float64(size-current) / speed * float64(time.Second))
+			}
+		} else if size == 0 {
+			p.Percent = 100
+		}
+		poll(p)
+	}, interval)
+}
+
+// newSnapshotReporter returns a reporter that sends a ProgressSnapshot to
+// the given function. Errors are logged and otherwise ignored.
+func (d *Downloader) newSnapshotReporter(reporter func(ctx context.Context, snapshot ProgressSnapshot) error) func(final bool) {
+	return func(final bool) {
+		if err := reporter(d.ctx, d.Snapshot()); err != nil {
+			d.config.logWarn("reporting download progress", "url", d.URL, "error", err)
+		}
+	}
+}
+
+// newLogReporter returns a reporter that logs a line like
+// "downloading https://example.com/file: 40% 2.3 MB/s" at info level on
+// Config.Logger. Nothing is logged at the end of the download.
+func (d *Downloader) newLogReporter() func(final bool) {
+	return func(final bool) {
+		if final {
+			return
+		}
+		completed, total := d.Progress()
+		d.config.Logger.Info("downloading "+d.URL+": "+d.statusLine(),
+			"url", d.URL, "path", d.path, "completed", completed, "total", total)
+	}
+}
+
+// progressEvent is the JSON encoding of the progress written on
+// Config.ProgressJSONWriter
+type progressEvent struct {
+	Completed int64   `json:"completed"`
+	Total     int64   `json:"total"`
+	BPS       float64 `json:"bps"`
+	// ETA is in seconds
+	ETA   float64 `json:"eta"`
+	State string  `json:"state"`
+}
+
+// newJSONReporter returns a reporter that writes the progress on out as
+// newline-delimited JSON. The last event has the final state of the
+// download. Errors are logged and otherwise ignored.
+func (d *Downloader) newJSONReporter(out io.Writer) func(final bool) {
+	enc := json.NewEncoder(out)
+	return func(final bool) {
+		completed, total := d.Progress()
+		state := Running
+		if final {
+			state = stateFromError(d.err)
+		}
+		err := enc.Encode(progressEvent{
+			Completed: completed,
+			Total:     total,
+			BPS:       d.BytesPerSecond(),
+			ETA:       d.ETA().Seconds(),
+			State:     state.String(),
+		})
+		if err != nil {
+			d.config.logWarn("writing download progress", "url", d.URL, "error", err)
+		}
+	}
+}
+
+// newStatusLineReporter returns a reporter that renders a status line like
+// "45% 2.3 MB/s ETA 12s" on out, updated in place with a carriage return.
+// The line is cleared at the end of the download.
+func (d *Downloader) newStatusLineReporter(out io.Writer) func(final bool) {
+	lastLen := 0
+	return func(final bool) {
+		if final {
+			if lastLen > 0 {
+				fmt.Fprintf(out, "\r%s\r", strings.Repeat(" ", lastLen))
+			}
+			return
+		}
+		line := d.statusLine()
+		pad := ""
+		if len(line) < lastLen {
+			pad = strings.Repeat(" ", lastLen-len(line))
+		}
+		fmt.Fprintf(out, "\r%s%s", line, pad)
+		lastLen = len(line)
+	}
+}
+
+// statusLine returns a human readable description of the progress of the
+// download.
+func (d *Downloader) statusLine() string {
+	completed, size := d.Progress()
+	rate := formatBytes(d.BytesPerSecond()) + "/s"
+	if size < 0 {
+		return formatBytes(float64(completed)) + " " + rate
+	}
+	percent := 100
+	if size > 0 {
+		percent = int(completed * 100 / size)
+	}
+	line := fmt.Sprintf("%d%% %s", percent, rate)
+	if eta := d.ETA().Round(time.Second); eta > 0 {
+		line += " ETA " + eta.String()
+	}
+	return line
+}
+
+// formatBytes formats an amount of bytes using decimal units (kB, MB, ...).
+func formatBytes(n float64) string {
+	if n < 1000 {
+		return fmt.Sprintf("%.0f B", n)
+	}
+	units := "kMGTPE"
+	i := 0
+	for n /= 1000; n >= 1000 && i < len(units)-1; i++ {
+		n /= 1000
+	}
+	return fmt.Sprintf("%.1f %cB", n, units[i])
+}
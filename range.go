@@ -0,0 +1,67 @@
+//
+// Copyright 2018 Cristian Maglie. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// OpenRange requests the bytes from start to end (both included) of the
+// specified url, and returns a reader over them together with the total size
+// of the remote file (or -1 if the server doesn't report it). Nothing is
+// written to disk. The caller must close the returned reader.
+func OpenRange(ctx context.Context, reqURL string, start, end int64, config Config) (io.ReadCloser, int64, error) {
+	if start < 0 || end < start {
+		return nil, 0, fmt.Errorf("invalid range %d-%d", start, end)
+	}
+	req, err := newRequest(ctx, "GET", reqURL, config)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	client := config.httpClient()
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		body := resp.Body
+		if config.ownsTransport() {
+			body = &closeIdleOnClose{ReadCloser: body, client: client}
+		}
+		return body, parseContentRangeSize(resp.Header.Get("Content-Range")), nil
+	default:
+		_ = resp.Body.Close()
+		return nil, 0, fmt.Errorf("requesting range of %s: %w", reqURL, rangeError(resp))
+	}
+}
+
+// rangeError returns the error for a response to a range request that isn't
+// 206 Partial Content.
+func rangeError(resp *http.Response) error {
+	if resp.StatusCode == http.StatusOK {
+		return ErrRangeNotSupported
+	}
+	return &HTTPStatusError{Code: resp.StatusCode, Status: resp.Status}
+}
+
+// closeIdleOnClose closes the idle connections of the client when the body
+// is closed.
+type closeIdleOnClose struct {
+	io.ReadCloser
+	client *http.Client
+}
+
+func (c *closeIdleOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.client.CloseIdleConnections()
+	return err
+}
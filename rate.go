@@ -0,0 +1,212 @@
+//
+// Copyright 2018 Cristian Maglie. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// RateEstimator estimates the transfer rate of a download. Observe is
+// called by the downloader each time the download progresses, with the total
+// number of bytes transferred so far.
+type RateEstimator interface {
+	// Observe records that a total of bytes have been transferred at the
+	// given time.
+	Observe(bytes int64, at time.Time)
+
+	// BytesPerSecond returns the estimated transfer rate, or 0 if not known.
+	BytesPerSecond() float64
+
+	// ETA returns the estimated time to transfer the remaining bytes, or 0
+	// if not known.
+	ETA(remaining int64) time.Duration
+}
+
+// defaultMaxETAWarmUp is the warm-up period before the ETA is checked
+// against Config.MaxETA if Config.MaxETAWarmUp is not set.
+const defaultMaxETAWarmUp = 5 * time.Second
+
+// emaSampleInterval is the minimum interval between two samples of the
+// EMA rate estimator.
+const emaSampleInterval = 200 * time.Millisecond
+
+// NewEMARateEstimator returns a RateEstimator that computes an exponential
+// moving average of the transfer rate, sampled every 200ms. alpha is the
+// smoothing factor (between 0 and 1): higher values discount older samples
+// faster. This is the estimator used by default, with an alpha of 0.3.
+func NewEMARateEstimator(alpha float64) RateEstimator {
+	return &emaRateEstimator{alpha: alpha}
+}
+
+type emaRateEstimator struct {
+	lock      sync.Mutex
+	alpha     float64
+	rate      float64
+	lastBytes int64
+	lastTime  time.Time
+	started   bool
+	hasRate   bool
+}
+
+func (e *emaRateEstimator) Observe(bytes int64, at time.Time) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if !e.started {
+		e.lastBytes, e.lastTime, e.started = bytes, at, true
+		return
+	}
+	dt := at.Sub(e.lastTime)
+	if dt < emaSampleInterval {
+		return
+	}
+	sample := float64(bytes-e.lastBytes) / dt.Seconds()
+	if e.hasRate {
+		e.rate = e.alpha*sample + (1-e.alpha)*e.rate
+	} else {
+		e.rate, e.hasRate = sample, true
+	}
+	e.lastBytes, e.lastTime = bytes, at
+}
+
+func (e *emaRateEstimator) BytesPerSecond() float64 {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.rate
+}
+
+func (e *emaRateEstimator) ETA(remaining int64) time.Duration {
+	rate := e.BytesPerSecond()
+	if rate <= 0 || remaining <= 0 {
+		return 0
+	}
+	return time.Duration(float64(remaining) / rate * float64(time.Second))
+}
+
+// BytesPerSecond returns the estimated transfer rate of the download.
+func (d *Downloader) BytesPerSecond() float64 {
+	return d.rateEstimator().BytesPerSecond()
+}
+
+// ETA returns the estimated time to complete the download, or 0 if it can't
+// be estimated (for example because the size of the download is unknown).
+func (d *Downloader) ETA() time.Duration {
+	completed, size := d.Progress()
+	if size < 0 {
+		return 0
+	}
+	return d.rateEstimator().ETA(size - completed)
+}
+
+// checkETA returns ErrETAExceeded if, after the warm-up period (restarted
+// when the download is resumed after a pause), the estimated time to
+// complete the download exceeds Config.MaxETA.
+func (d *Downloader) checkETA() error {
+	if d.config.MaxETA <= 0 {
+		return nil
+	}
+	warmUp := d.config.MaxETAWarmUp
+	if warmUp <= 0 {
+		warmUp = defaultMaxETAWarmUp
+	}
+	d.pauseLock.Lock()
+	warmUpStart := d.warmUpStart
+	d.pauseLock.Unlock()
+	if time.Since(warmUpStart) < warmUp {
+		return nil
+	}
+	if eta := d.ETA(); eta > d.config.MaxETA {
+		return fmt.Errorf("%w: estimated %s, limit %s", ErrETAExceeded, eta.Round(time.Millisecond), d.config.MaxETA)
+	}
+	return nil
+}
+
+// rateEstimator returns the RateEstimator of the download, creating the
+// default one if needed.
+func (d *Downloader) rateEstimator() RateEstimator {
+	d.rateLock.Lock()
+	defer d.rateLock.Unlock()
+	if d.rate == nil {
+		if d.config.RateEstimator != nil {
+			d.rate = d.config.RateEstimator
+		} else {
+			d.rate = NewEMARateEstimator(0.3)
+		}
+	}
+	return d.rate
+}
+
+// throttle limits the average transfer rate of a download.
+type throttle struct {
+	limit int64
+	// rampUp is the time taken by the rate to grow linearly from zero to
+	// limit
+	rampUp time.Duration
+	lock   sync.Mutex
+	start  time.Time
+	count  int64
+}
+
+// newThrottle returns a throttle limiting the transfer to bytesPerSecond,
+// reached after rampUp, or nil if there is no limit.
+func newThrottle(bytesPerSecond int64, rampUp time.Duration) *throttle {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &throttle{limit: bytesPerSecond, rampUp: rampUp}
+}
+
+// elapsed returns the time needed to transfer count bytes since the start
+// of the transfer.
+func (t *throttle) elapsed(count int64) time.Duration {
+	limit := float64(t.limit)
+	rampUp := t.rampUp.Seconds()
+	// Bytes transferred during the ramp up, at a rate growing linearly
+	rampUpBytes := limit * rampUp / 2
+	var seconds float64
+	if float64(count) <= rampUpBytes {
+		seconds = math.Sqrt(2 * rampUp * float64(count) / limit)
+	} else {
+		seconds = rampUp + (float64(count)-rampUpBytes)/limit
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// wait records the transfer of n bytes and blocks until the average rate
+// since the start of the transfer is within the limit, or the context is
+// cancelled. It's a no-op on a nil throttle.
+func (t *throttle) wait(ctx context.Context, n int) error {
+	if t == nil {
+		return nil
+	}
+	t.lock.Lock()
+	now := time.Now()
+	if t.start.IsZero() {
+		t.start = now
+	}
+	t.count += int64(n)
+	due := t.start.Add(t.elapsed(t.count))
+	t.lock.Unlock()
+	return sleep(ctx, due.Sub(now))
+}
+
+// skip excludes a period without transfers, like a pause, from the average
+// rate, so that it can't be recovered with a burst. It's a no-op on a nil
+// throttle.
+func (t *throttle) skip(d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	if !t.start.IsZero() {
+		t.start = t.start.Add(d)
+	}
+	t.lock.Unlock()
+}
@@ -0,0 +1,137 @@
+//
+// Copyright 2018 Cristian Maglie. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package downloader
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// RecorderMode is the operating mode of a Recorder
+type RecorderMode int
+
+const (
+	// RecordMode performs the requests and saves the responses
+	RecordMode RecorderMode = iota
+	// ReplayMode serves the previously saved responses without using the
+	// network
+	ReplayMode
+)
+
+// Recorder is an http.RoundTripper that records the HTTP responses into a
+// directory and replays them later, to allow testing downloads without
+// network access. It can be used as Config.Transport.
+type Recorder struct {
+	// Transport is the http.RoundTripper used to perform the requests in
+	// RecordMode. If nil http.DefaultTransport is used.
+	Transport http.RoundTripper
+
+	dir  string
+	mode RecorderMode
+}
+
+// NewRecorder returns a Recorder that saves (RecordMode) or loads
+// (ReplayMode) the responses in the specified directory.
+func NewRecorder(dir string, mode RecorderMode) *Recorder {
+	return &Recorder{dir: dir, mode: mode}
+}
+
+type recordedResponse struct {
+	Method        string
+	URL           string
+	Status        string
+	StatusCode    int
+	Header        http.Header
+	ContentLength int64
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := r.key(req)
+	if r.mode == ReplayMode {
+		return r.replay(req, key)
+	}
+
+	transport := r.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("recording response body: %s", err)
+	}
+	meta, err := json.Marshal(&recordedResponse{
+		Method:        req.Method,
+		URL:           req.URL.String(),
+		Status:        resp.Status,
+		StatusCode:    resp.StatusCode,
+		Header:        resp.Header,
+		ContentLength: resp.ContentLength,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("recording response: %s", err)
+	}
+	if err := os.MkdirAll(r.dir, 0755); err != nil {
+		return nil, fmt.Errorf("recording response: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(r.dir, key+".json"), meta, 0644); err != nil {
+		return nil, fmt.Errorf("recording response: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(r.dir, key+".body"), body, 0644); err != nil {
+		return nil, fmt.Errorf("recording response body: %s", err)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+func (r *Recorder) replay(req *http.Request, key string) (*http.Response, error) {
+	meta, err := os.ReadFile(filepath.Join(r.dir, key+".json"))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no recorded response for %s %s", req.Method, req.URL)
+	} else if err != nil {
+		return nil, fmt.Errorf("replaying response: %s", err)
+	}
+	var recorded recordedResponse
+	if err := json.Unmarshal(meta, &recorded); err != nil {
+		return nil, fmt.Errorf("replaying response: %s", err)
+	}
+	body, err := os.ReadFile(filepath.Join(r.dir, key+".body"))
+	if err != nil {
+		return nil, fmt.Errorf("replaying response body: %s", err)
+	}
+	return &http.Response{
+		Status:        recorded.Status,
+		StatusCode:    recorded.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        recorded.Header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: recorded.ContentLength,
+		Request:       req,
+	}, nil
+}
+
+// key returns the name used to store the response to the given request
+func (r *Recorder) key(req *http.Request) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", req.Method, req.URL)
+	fmt.Fprintf(h, "Range: %s\n", req.Header.Get("Range"))
+	return hex.EncodeToString(h.Sum(nil))
+}
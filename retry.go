@@ -0,0 +1,179 @@
+//
+// Copyright 2018 Cristian Maglie. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultRetryDelay is the delay before the first retry if
+// Config.RetryDelay is not set.
+const defaultRetryDelay = time.Second
+
+// RetryState is the state of the retries of the requests to an url.
+type RetryState struct {
+	// Attempts is the number of failed attempts so far.
+	Attempts int
+	// NextRetry is the time before which the next attempt must not be done.
+	NextRetry time.Time
+}
+
+// RetryStateStore persists the RetryState of the urls, so that the backoff
+// between the retries is honored even if the process is restarted (see
+// Config.RetryStateStore).
+type RetryStateStore interface {
+	// LoadRetryState returns the state stored for the url, or an empty
+	// RetryState if there is none.
+	LoadRetryState(url string) (RetryState, error)
+	// SaveRetryState stores the state for the url. An empty RetryState is
+	// saved when the request succeeds.
+	SaveRetryState(url string, state RetryState) error
+}
+
+// doRequest sends the GET request for the download, retrying it on failure
+// as configured by Config.MaxRetries. If offset is greater than zero the
+// download is resumed from it, and ifRange, if not empty, is sent in the
+// If-Range header. Otherwise ifModifiedSince, if not empty, is sent in the
+// If-Modified-Since header.
+func doRequest(ctx context.Context, client *http.Client, reqURL string, config Config, offset int64, ifRange, ifModifiedSince string) (*http.Response, error) {
+	state := RetryState{}
+	if store := config.RetryStateStore; store != nil {
+		var err error
+		if state, err = store.LoadRetryState(reqURL); err != nil {
+			return nil, fmt.Errorf("loading retry state: %s", err)
+		}
+	}
+	for {
+		if err := sleep(ctx, time.Until(state.NextRetry)); err != nil {
+			return nil, err
+		}
+		resp, err := doRequestOnce(ctx, client, reqURL, config, offset, ifRange, ifModifiedSince)
+		if !isRetryable(resp, err) {
+			if state.Attempts > 0 {
+				if err := config.saveRetryState(reqURL, RetryState{}); err != nil {
+					if resp != nil {
+						_ = resp.Body.Close()
+					}
+					return nil, err
+				}
+			}
+			return resp, err
+		}
+		if state.Attempts >= config.MaxRetries || ctx.Err() != nil {
+			return resp, err
+		}
+
+		state.Attempts++
+		delay := config.retryDelay(state.Attempts)
+		if err == nil {
+			if retryAfter, ok := parseRetryAfter(resp); ok {
+				delay = retryAfter
+			}
+			err = &HTTPStatusError{Code: resp.StatusCode, Status: resp.Status}
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+			_ = resp.Body.Close()
+		}
+		state.NextRetry = time.Now().Add(delay)
+		if err := config.saveRetryState(reqURL, state); err != nil {
+			return nil, err
+		}
+		config.logWarn("request failed, retrying", "url", reqURL, "attempt", state.Attempts, "error", err)
+		reportWarning(ctx, fmt.Errorf("request to %s failed, retrying: %w", reqURL, err))
+	}
+}
+
+// isRetryable returns true if the request failed with an error that may be
+// solved by retrying it.
+func isRetryable(resp *http.Response, err error) bool {
+	if err != nil {
+		var redirectsErr *TooManyRedirectsError
+		return !errors.Is(err, ErrHostNotAllowed) && !errors.Is(err, ErrCertPinMismatch) &&
+			!errors.Is(err, os.ErrNotExist) && !errors.Is(err, ErrFileRedirect) && !errors.As(err, &redirectsErr)
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// parseRetryAfter returns the delay requested by the server in the
+// Retry-After header of a 429 or 503 response, either in seconds or as an
+// HTTP date.
+func parseRetryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	value := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		delay := time.Until(date)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+	return 0, false
+}
+
+// retryDelay returns the delay before the given attempt, doubling the
+// configured RetryDelay at each attempt.
+func (c *Config) retryDelay(attempt int) time.Duration {
+	delay := c.RetryDelay
+	if delay <= 0 {
+		delay = defaultRetryDelay
+	}
+	for i := 1; i < attempt && i < 16; i++ {
+		delay *= 2
+	}
+	return delay
+}
+
+func (c *Config) saveRetryState(reqURL string, state RetryState) error {
+	if c.RetryStateStore == nil {
+		return nil
+	}
+	if err := c.RetryStateStore.SaveRetryState(reqURL, state); err != nil {
+		return fmt.Errorf("saving retry state: %s", err)
+	}
+	return nil
+}
+
+// sleep waits for the given duration or until the context is cancelled.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
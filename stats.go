@@ -0,0 +1,102 @@
+//
+// Copyright 2018 Cristian Maglie. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package downloader
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Stats contains the timing statistics of a download.
+type Stats struct {
+	// SetupDuration is the time from the start of the request (including
+	// the connection setup and the redirects) to the arrival of the response
+	// headers.
+	SetupDuration time.Duration
+	// TransferDuration is the time from the first to the last byte of the
+	// content received so far.
+	TransferDuration time.Duration
+}
+
+// requestTiming collects the timing of a request through httptrace.
+type requestTiming struct {
+	lock        sync.Mutex
+	start       time.Time
+	gotResponse time.Time
+}
+
+type requestTimingKey struct{}
+
+// withRequestTiming returns a context that collects the timing of the
+// requests made with it.
+func withRequestTiming(ctx context.Context) context.Context {
+	timing := &requestTiming{}
+	trace := &httptrace.ClientTrace{
+		GetConn: func(string) {
+			timing.lock.Lock()
+			if timing.start.IsZero() {
+				timing.start = time.Now()
+			}
+			timing.lock.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			timing.lock.Lock()
+			timing.gotResponse = time.Now()
+			timing.lock.Unlock()
+		},
+	}
+	ctx = httptrace.WithClientTrace(ctx, trace)
+	return context.WithValue(ctx, requestTimingKey{}, timing)
+}
+
+// setupDuration returns the setup duration of the request of the response.
+func setupDuration(resp *http.Response) time.Duration {
+	if resp.Request == nil {
+		return 0
+	}
+	timing, ok := resp.Request.Context().Value(requestTimingKey{}).(*requestTiming)
+	if !ok {
+		return 0
+	}
+	timing.lock.Lock()
+	defer timing.lock.Unlock()
+	if timing.start.IsZero() || timing.gotResponse.IsZero() {
+		return 0
+	}
+	return timing.gotResponse.Sub(timing.start)
+}
+
+// addProgress records that read bytes have been received from the network
+// and written bytes have been written to the output, and returns the total
+// bytes completed.
+func (d *Downloader) addProgress(read, written int64) int64 {
+	now := time.Now()
+	d.completedLock.Lock()
+	defer d.completedLock.Unlock()
+	if read > 0 {
+		d.downloaded += read
+		if d.firstByte.IsZero() {
+			d.firstByte = now
+		}
+		d.lastByte = now
+	}
+	d.completed += written
+	return d.completed
+}
+
+// Stats returns the timing statistics of the download.
+func (d *Downloader) Stats() Stats {
+	d.completedLock.Lock()
+	defer d.completedLock.Unlock()
+	return Stats{
+		SetupDuration:    d.setupDuration,
+		TransferDuration: d.lastByte.Sub(d.firstByte),
+	}
+}
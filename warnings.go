@@ -0,0 +1,77 @@
+//
+// Copyright 2018 Cristian Maglie. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package downloader
+
+import (
+	"context"
+	"sync"
+)
+
+// warningsBufferSize is the number of warnings buffered in the channel
+// returned by Downloader.Warnings.
+const warningsBufferSize = 16
+
+// warnings collects the non-fatal errors of a download. It's carried in the
+// context of the download, so that the errors that happen before the
+// Downloader is created (like the retries of the first request) are
+// collected too.
+type warnings struct {
+	lock   sync.Mutex
+	ch     chan error
+	closed bool
+}
+
+type warningsKey struct{}
+
+// withWarnings returns a context collecting the warnings of a download. If
+// ctx already collects warnings it's returned as is.
+func withWarnings(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(warningsKey{}).(*warnings); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, warningsKey{}, &warnings{ch: make(chan error, warningsBufferSize)})
+}
+
+// warningsFrom returns the warnings collector of the context.
+func warningsFrom(ctx context.Context) *warnings {
+	if w, ok := ctx.Value(warningsKey{}).(*warnings); ok {
+		return w
+	}
+	return &warnings{ch: make(chan error, warningsBufferSize)}
+}
+
+// reportWarning sends a non-fatal error to the warnings collector of the
+// context, if any. If the buffer is full the oldest warning is dropped.
+func reportWarning(ctx context.Context, err error) {
+	w, ok := ctx.Value(warningsKey{}).(*warnings)
+	if !ok {
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if !w.closed {
+		sendLatest(w.ch, err)
+	}
+}
+
+func (w *warnings) close() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if !w.closed {
+		w.closed = true
+		close(w.ch)
+	}
+}
+
+// Warnings returns a channel that receives the non-fatal errors of the
+// download as they happen, for example a failed request that is being
+// retried or a mirror that has been skipped. The fatal error, if any, is
+// still returned by Error. The channel buffers the last 16 warnings and is
+// closed when the download ends.
+func (d *Downloader) Warnings() <-chan error {
+	return d.warnings.ch
+}